@@ -1,36 +1,49 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/jroimartin/gocui"
-	"github.com/xthexder/go-jack"
+	"keyboard3000/pkg/clock"
 	"keyboard3000/pkg/hardware"
 	"keyboard3000/pkg/keyboard"
 	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/sink"
+	"keyboard3000/pkg/smf"
 	"os"
 	"os/signal"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 var (
-	activeDevices    []hardware.DeviceInfo                             // active devices
-	keyboardDevices  = make(map[hardware.InputID]*keyboard.MidiDevice) // todo: simplify structure
-	devicePorts      = make(map[hardware.InputID]*jack.Port)           // just an local unused collection of opened midi ports
-	midiEvents       = make(chan keyboard.MidiEvent, 50)               // main midi event channel
-	midiEventsToSend = make(chan keyboard.MidiEvent, 50)
-
-	jackClient *jack.Client // global Jack client
-	termUI     gocui.Gui
-
-	midiPrepareMutex = &sync.Mutex{} // sync midiPrepareMutex between `process` and `prepareMidiToSend` functions
-	devRefreshSync   = &sync.Mutex{}
-	midiBuffers      = make(map[*jack.Port]jack.MidiBuffer)
-
-	jackBufferSize uint32
-	jackSampleRate uint32
+	activeDevices   []hardware.DeviceInfo                             // active devices
+	keyboardDevices = make(map[hardware.InputID]*keyboard.MidiDevice) // todo: simplify structure
+	devicePorts     = make(map[hardware.InputID][]sink.Port)          // opened midi ports of every device, main one first
+	midiEvents      = make(chan keyboard.MidiEvent, 50)               // main midi event channel
+
+	midiSink  sink.MidiSink // midi output backend, JACK or ALSA sequencer
+	midiClock *clock.Clock  // shared tempo and transport
+
+	clockSubscriptions = make(map[hardware.InputID]int) // clock subscription of every device
+	termUI             gocui.Gui
+
+	devRefreshSync = &sync.Mutex{}
+
+	recorder    *smf.Recorder                // current recording, nil if not recording
+	portTracks  = make(map[sink.Port]string) // recording track name of every port, main port name of its device
+	recordMutex = &sync.Mutex{}
+
+	backend   = flag.String("backend", sink.Jack, "midi output backend, \"jack\", \"alsa\" or \"file\"")
+	output    = flag.String("output", "-", "JSON lines output of file backend, \"-\" for standard output")
+	headless  = flag.Bool("headless", false, "no terminal UI, logs go to standard error")
+	record    = flag.String("record", "", "records every device into given Standard MIDI File from the start")
+	clockMode = flag.String("clock", clock.Internal, "clock source, \"internal\", \"midi\" (clock_in port) or \"jack\" (transport)")
+	latency   = flag.Float64("latency", 0, "JACK output latency in ms, events are sent this long after key press, one period if not set")
+	tempo     = flag.Float64("tempo", 0, "initial tempo of internal clock, tempo of device config is used if not set")
 )
 
 const (
@@ -40,59 +53,95 @@ const (
 	DeviceWindow = "devices"
 )
 
-// Receives midi events in realtime and prepare them to be sent in `process` callback
-func prepareMidiToSend() {
-	var event keyboard.MidiEvent
-	var estimatedTime uint32
-
-	for event = range midiEvents {
-		midiPrepareMutex.Lock()
-		estimatedTime = jackClient.GetFramesSinceCycleStart()
+// Passes midi events of every device to the midi backend
+func sendMidiEvents() {
+	for event := range midiEvents {
+		midiSink.Send(event.Port, event.Data, event.Time)
 
-		if estimatedTime >= jackBufferSize { //todo: something
-			midiEvents <- event
-			midiPrepareMutex.Unlock()
-			continue
+		recordMutex.Lock()
+		if recorder != nil {
+			recorder.Record(portTracks[event.Port], event.Time, event.Data)
 		}
+		recordMutex.Unlock()
+	}
+}
 
-		event.Data.Time = estimatedTime // overriding midi-time with estimated one
+// connects clock to its external source in follow modes
+func followClock() error {
+	if midiClock.Mode() == clock.Internal {
+		return nil
+	}
 
-		midiEventsToSend <- event
-		midiPrepareMutex.Unlock()
+	source, ok := midiSink.(sink.ClockSource)
+	if !ok {
+		return fmt.Errorf("%s backend doesn't provide clock, jack backend is required", *backend)
 	}
+
+	switch midiClock.Mode() {
+	case clock.Midi:
+		return source.OpenClockInput("clock_in", midiClock.Receive)
+	case clock.Jack:
+		source.FollowTransport(func(transport sink.Transport) {
+			midiClock.Follow(transport.Rolling, transport.Frame, transport.Tempo, transport.BBT)
+		})
+	}
+	return nil
 }
 
-func process(nframes uint32) int {
-	midiPrepareMutex.Lock()
-	for _, port := range devicePorts { // every port buffer needs to be clear every cycle
-		midiBuffers[port] = port.MidiClearBuffer(nframes)
+func startRecording(path string) {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	if recorder != nil {
+		return
 	}
+	recorder = smf.NewRecorder(path)
+	logging.Infof("Recording started: \"%s\"", path)
+}
 
-	for {
-		if len(midiEventsToSend) == 0 {
-			break
-		}
-		event := <-midiEventsToSend
+// saves current recording, if any
+func stopRecording() {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
 
-		err := event.Port.MidiEventWrite(&event.Data, midiBuffers[event.Port])
-		if err != 0 {
-			midiEventsToSend <- event
-			break
-		}
+	if recorder == nil {
+		return
+	}
+	if err := recorder.Save(); err != nil {
+		logging.Infof("Failed to save recording \"%s\": %s", recorder.Path(), err)
+		fmt.Fprintf(os.Stderr, "Failed to save recording \"%s\": %s\n", recorder.Path(), err)
+	} else {
+		logging.Infof("Recording saved: \"%s\"", recorder.Path())
 	}
+	recorder = nil
+}
 
-	midiPrepareMutex.Unlock()
-	return 0
+// "record_toggle" control, every recording gets its own timestamped file
+func toggleRecording() {
+	recordMutex.Lock()
+	recording := recorder != nil
+	recordMutex.Unlock()
+
+	if recording {
+		stopRecording()
+	} else {
+		startRecording(fmt.Sprintf("%s_%s.mid", strings.ToLower(appName), time.Now().Format("20060102_150405")))
+	}
 }
 
 func shutdown() {
-	termUI.Close()
+	if !*headless {
+		termUI.Close()
+	}
 
 	for _, device := range keyboardDevices {
 		device.Close()
 	}
-	time.Sleep(time.Millisecond * 100) // make sure that Panic events will be processed by jack process() callback
-	jackClient.Close()
+	time.Sleep(time.Millisecond * 100) // make sure that Panic events will be processed by midi backend
+	stopRecording()                    // after Panic events, so recorded notes are closed
+	if midiSink != nil {
+		midiSink.Close()
+	}
 
 	os.Exit(0)
 }
@@ -113,24 +162,6 @@ func attachSigHandler() {
 	}()
 }
 
-// plox JACK server for keyboard socket
-func midiSocketPlox(name string) *jack.Port {
-	port := jackClient.PortRegister(name, jack.DEFAULT_MIDI_TYPE, jack.PortIsOutput, 0)
-	if port != nil {
-		return port
-	}
-
-	// in case of already opened port with requested name adding suffixes is tried
-	for i := 0; i < 128; i++ {
-		portName := fmt.Sprintf("%s_%d", name, i)
-		port := jackClient.PortRegister(portName, jack.DEFAULT_MIDI_TYPE, jack.PortIsOutput, 0)
-		if port != nil {
-			return port
-		}
-	}
-	panic("port-related shiet occurred")
-}
-
 func pluggedDevices(current []hardware.DeviceInfo) []hardware.DeviceInfo {
 	var devices []hardware.DeviceInfo
 
@@ -199,23 +230,30 @@ func deviceMonitor() {
 
 			handler := hardware.NewHandler(fd, dev)
 			midiDevice := keyboard.New(&handler, &midiEvents)
-			midiPort := midiSocketPlox(midiDevice.Config.Identification.NiceName)
+			midiPort := openPort(midiDevice.Config.Identification.NiceName)
 			midiDevice.MidiPort = midiPort
+			midiDevice.OnRecordToggle = toggleRecording
+			midiDevice.Clock = midiClock
+
+			ports := []sink.Port{midiPort}
+			autoConnect(midiPort, midiDevice.Config.AutoConnect)
+
+			for _, output := range midiDevice.Outputs() { // additional zone outputs
+				outputPort := openPort(fmt.Sprintf("%s_%s", midiDevice.Config.Identification.NiceName, output))
+				midiDevice.OutputPorts[output] = outputPort
+				ports = append(ports, outputPort)
+				autoConnect(outputPort, midiDevice.AutoConnect(output))
+			}
 
 			keyboardDevices[dev.Identifier()] = midiDevice
-			devicePorts[dev.Identifier()] = midiPort
-
-			for _, target := range midiDevice.Config.AutoConnect {
-				targetPort := jackClient.GetPortByName(target)
-				if targetPort != nil {
-					code := jackClient.ConnectPorts(midiPort, targetPort)
-					if code != 0 {
-						logging.Infof("Autoconnect failed from \"%s\" to \"%s\"", midiPort, targetPort)
-					} else {
-						logging.Infof("Autoconnect succeeded from \"%s\" to \"%s\"", midiPort, targetPort)
-					}
-				}
+			devicePorts[dev.Identifier()] = ports
+			clockSubscriptions[dev.Identifier()] = midiClock.Subscribe(midiDevice.SendClock)
+
+			recordMutex.Lock()
+			for _, port := range ports {
+				portTracks[port] = midiPort.Name()
 			}
+			recordMutex.Unlock()
 
 			logging.Infof("Run keyboard: \"%s\"", dev.Name)
 
@@ -231,8 +269,15 @@ func deviceMonitor() {
 				panic("Looks like pre-ultimate shiet occurred")
 			}
 
+			midiClock.Unsubscribe(clockSubscriptions[dev.Identifier()])
+			delete(clockSubscriptions, dev.Identifier())
 			keyboardDev.Close()
-			jackClient.PortUnregister(devicePorts[dev.Identifier()])
+			recordMutex.Lock()
+			for _, port := range devicePorts[dev.Identifier()] {
+				midiSink.ClosePort(port)
+				delete(portTracks, port)
+			}
+			recordMutex.Unlock()
 
 			delete(keyboardDevices, dev.Identifier())
 			delete(devicePorts, dev.Identifier())
@@ -243,6 +288,27 @@ func deviceMonitor() {
 	}
 }
 
+// plox midi backend for keyboard socket
+func openPort(name string) sink.Port {
+	port, err := midiSink.OpenPort(name)
+	if err != nil {
+		logging.Infof("Failed to open port: %s", err)
+		panic("port-related shiet occurred")
+	}
+	return port
+}
+
+func autoConnect(port sink.Port, targets []string) {
+	for _, target := range targets {
+		err := midiSink.Connect(port, target)
+		if err != nil {
+			logging.Infof("Autoconnect failed from \"%s\" to \"%s\": %s", port.Name(), target, err)
+		} else {
+			logging.Infof("Autoconnect succeeded from \"%s\" to \"%s\"", port.Name(), target)
+		}
+	}
+}
+
 // https://stackoverflow.com/questions/37334119/how-to-delete-an-element-from-array-in-golang/37335777
 // todo: remove this cancer
 func remove(s []hardware.DeviceInfo, i int) []hardware.DeviceInfo {
@@ -260,6 +326,7 @@ func lookupForIndex(slice []hardware.DeviceInfo, value hardware.DeviceInfo) int
 }
 
 func main() {
+	flag.Parse()
 	attachSigHandler()
 
 	// collecting input devices
@@ -279,36 +346,37 @@ func main() {
 	}
 	logging.Infof("finding event paths takes me: %s", time.Since(now))
 
-	// opening JackClient
-	var status int
-	jackClient, status = jack.ClientOpen(appName, jack.NoStartServer)
-	if status != 0 {
-		panic("jack-Shiet")
-	}
-	defer jackClient.Close()
-
-	jackBufferSize = jackClient.GetBufferSize()
-	jackSampleRate = jackClient.GetSampleRate()
-	status = jackClient.SetBufferSizeCallback(func(buffer uint32) int { jackBufferSize = buffer; return 0 })
-	if status != 0 {
-		panic("failed to set buffer size callback")
+	// opening midi backend
+	midiSink, err = sink.New(*backend, appName, *output, time.Duration(*latency*float64(time.Millisecond)), shutdown)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s midi backend: %s\n", *backend, err)
+		os.Exit(1)
 	}
-
-	jackClient.OnShutdown(shutdown)
 	defer shutdown()
 
-	status = jackClient.SetProcessCallback(process)
-	if status != 0 {
-		panic("jack-ultimate-shiet")
+	midiClock, err = clock.New(*clockMode, *tempo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up clock: %s\n", err)
+		os.Exit(1)
+	}
+	if err := followClock(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to follow %s clock: %s\n", *clockMode, err)
+		os.Exit(1)
 	}
 
-	if code := jackClient.Activate(); code != 0 {
-		logging.Infof("Failed to activate client, code: %d", code)
-		return
+	if *record != "" {
+		startRecording(*record)
 	}
 
 	go deviceMonitor()
-	go prepareMidiToSend()
+	go sendMidiEvents()
+
+	if *headless {
+		for message := range logging.LogMessages {
+			fmt.Fprintln(os.Stderr, message)
+		}
+		return
+	}
 	//
 	gui, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
@@ -382,8 +450,15 @@ func devicesUpdate(g *gocui.Gui) {
 			content = []byte(md.String() + "\n")
 			v.Write(content)
 		}
-		v.Write([]byte(fmt.Sprintf("\nbuffer size: %d, sample_rate: %d", jackBufferSize, jackSampleRate)))
-		v.Write([]byte(fmt.Sprintf("\nevents to process: %d, events to send in next callback: %d", len(midiEvents), len(midiEventsToSend))))
+		v.Write([]byte(fmt.Sprintf("\n%s", midiSink.Status())))
+		v.Write([]byte(fmt.Sprintf("\n%s", midiClock)))
+		v.Write([]byte(fmt.Sprintf("\nevents to process: %d", len(midiEvents))))
+
+		recordMutex.Lock()
+		if recorder != nil {
+			v.Write([]byte(fmt.Sprintf("\n%s", recorder.Status())))
+		}
+		recordMutex.Unlock()
 
 		time.Sleep(time.Millisecond * 10)
 	}
@@ -394,13 +469,13 @@ func layout(g *gocui.Gui) error {
 
 	devices := len(keyboardDevices)
 
-	if v, err := g.SetView(LogWindow, 0, devices+5, maxX-1, maxY-1); err != nil {
+	if v, err := g.SetView(LogWindow, 0, devices+7, maxX-1, maxY-1); err != nil {
 		v.Title = "[Logs]"
 		v.Autoscroll = true
 		v.Wrap = true
 	}
 
-	if v, err := g.SetView(DeviceWindow, 0, 0, maxX-1, devices+4); err != nil {
+	if v, err := g.SetView(DeviceWindow, 0, 0, maxX-1, devices+6); err != nil {
 		v.Title = "[Devices]"
 		v.Autoscroll = false
 		v.Wrap = false
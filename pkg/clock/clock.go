@@ -0,0 +1,275 @@
+// Package clock keeps shared tempo and transport state, driven by tap tempo, JACK transport or incoming midi clock
+package clock
+
+import (
+	"fmt"
+	"keyboard3000/pkg/midi"
+	"sync"
+	"time"
+)
+
+const (
+	Internal = "internal" // tempo from -tempo flag and tap tempo, midi clock is generated
+	Midi     = "midi"     // follows incoming midi clock and transport messages
+	Jack     = "jack"     // follows JACK transport tempo and state, midi clock is generated
+
+	PPQN = 24 // midi clock ticks per quarter note
+
+	tapTimeout = 2 * time.Second // taps with longer pause start new measurement
+	maxTaps    = 5
+)
+
+// Clock broadcasts transport and midi clock messages to subscribers, e.g. devices with clock output
+type Clock struct {
+	mode string
+
+	mutex    sync.Mutex
+	tempo    float64 // BPM, zero if not known
+	running  bool
+	taps     []time.Time
+	ticks    []time.Time   // received midi clock ticks, follow mode
+	stop     chan struct{} // closed when generator stops, nil if not generating
+	dropped  uint64        // messages dropped because subscribers were too slow
+	lastSeen time.Time     // last received midi clock tick
+
+	subscribers map[int]func(midi.Message)
+	nextID      int
+	messages    chan midi.Message // delivered by single goroutine, so subscribers get them in order
+}
+
+func New(mode string, tempo float64) (*Clock, error) {
+	switch mode {
+	case Internal, Midi, Jack:
+	default:
+		return nil, fmt.Errorf("unknown clock mode \"%s\"", mode)
+	}
+	if tempo < 0 {
+		return nil, fmt.Errorf("tempo should be positive")
+	}
+
+	c := &Clock{
+		mode:        mode,
+		tempo:       tempo,
+		subscribers: make(map[int]func(midi.Message)),
+		messages:    make(chan midi.Message, 256),
+	}
+	go c.deliver()
+	return c, nil
+}
+
+// Subscribe registers function receiving transport and clock messages, returned id is used by Unsubscribe
+func (c *Clock) Subscribe(subscriber func(midi.Message)) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextID += 1
+	c.subscribers[c.nextID] = subscriber
+	return c.nextID
+}
+
+func (c *Clock) Unsubscribe(id int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.subscribers, id)
+}
+
+func (c *Clock) deliver() {
+	for message := range c.messages {
+		c.mutex.Lock()
+		var subscribers []func(midi.Message)
+		for _, subscriber := range c.subscribers {
+			subscribers = append(subscribers, subscriber)
+		}
+		c.mutex.Unlock()
+
+		for _, subscriber := range subscribers {
+			subscriber(message)
+		}
+	}
+}
+
+// never blocks, callers may hold device locks which subscribers need
+func (c *Clock) broadcast(message midi.Message) {
+	select {
+	case c.messages <- message:
+	default:
+		c.dropped += 1
+	}
+}
+
+// Tempo returns current tempo, false if it's not known (no -tempo flag, taps or external clock yet)
+func (c *Clock) Tempo() (float64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tempo, c.tempo > 0
+}
+
+// Start starts transport from the beginning
+func (c *Clock) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.start(midi.NewStart())
+}
+
+// Continue starts transport from the position it was stopped at
+func (c *Clock) Continue() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.start(midi.NewContinue())
+}
+
+func (c *Clock) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.halt()
+}
+
+func (c *Clock) start(message midi.Message) {
+	c.halt()
+	c.running = true
+	c.broadcast(message)
+
+	if c.mode != Midi { // clock ticks are forwarded from input in follow mode
+		c.stop = make(chan struct{})
+		go c.generate(c.stop)
+	}
+}
+
+func (c *Clock) halt() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	if c.running {
+		c.running = false
+		c.broadcast(midi.NewStop())
+	}
+}
+
+// sends midi clock ticks while transport runs, tempo changes apply from the next tick
+func (c *Clock) generate(stop chan struct{}) {
+	next := time.Now()
+
+	for {
+		c.mutex.Lock()
+		tempo := c.tempo
+		if tempo <= 0 {
+			tempo = 120
+		}
+		c.broadcast(midi.NewTimingClock())
+		c.mutex.Unlock()
+
+		next = next.Add(time.Duration(float64(time.Minute) / tempo / PPQN))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Tap is tap tempo, tempo is average of intervals between recent taps
+func (c *Clock) Tap(at time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.mode != Internal {
+		return fmt.Errorf("tempo follows %s clock", c.mode)
+	}
+
+	if len(c.taps) > 0 && at.Sub(c.taps[len(c.taps)-1]) > tapTimeout {
+		c.taps = nil
+	}
+	c.taps = append(c.taps, at)
+	if len(c.taps) > maxTaps {
+		c.taps = c.taps[len(c.taps)-maxTaps:]
+	}
+	if len(c.taps) < 2 {
+		return nil
+	}
+
+	average := c.taps[len(c.taps)-1].Sub(c.taps[0]) / time.Duration(len(c.taps)-1)
+	if average <= 0 {
+		return nil
+	}
+	c.tempo = float64(time.Minute) / float64(average)
+	return nil
+}
+
+// Receive handles incoming realtime messages in midi follow mode, tempo is estimated from last quarter note of ticks
+func (c *Clock) Receive(message midi.Message, at time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.mode != Midi {
+		return
+	}
+
+	switch message.Status() {
+	case midi.TimingClock:
+		if at.Sub(c.lastSeen) > tapTimeout { // clock was paused, old ticks don't tell anything
+			c.ticks = nil
+		}
+		c.lastSeen = at
+		c.ticks = append(c.ticks, at)
+		if len(c.ticks) > PPQN+1 {
+			c.ticks = c.ticks[len(c.ticks)-PPQN-1:]
+		}
+		if len(c.ticks) > PPQN/4 {
+			interval := c.ticks[len(c.ticks)-1].Sub(c.ticks[0]) / time.Duration(len(c.ticks)-1)
+			if interval > 0 {
+				c.tempo = float64(time.Minute) / float64(interval) / PPQN
+			}
+		}
+		c.broadcast(message)
+	case midi.Start, midi.Continue:
+		c.running = true
+		c.broadcast(message)
+	case midi.Stop:
+		c.running = false
+		c.broadcast(message)
+	}
+}
+
+// Follow applies JACK transport state in jack follow mode, tempo is valid if transport master provides BBT
+func (c *Clock) Follow(rolling bool, frame uint32, tempo float64, tempoValid bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.mode != Jack {
+		return
+	}
+
+	if tempoValid && tempo > 0 {
+		c.tempo = tempo
+	}
+
+	switch {
+	case rolling && !c.running && frame == 0:
+		c.start(midi.NewStart())
+	case rolling && !c.running:
+		c.start(midi.NewContinue())
+	case !rolling && c.running:
+		c.halt()
+	}
+}
+
+func (c *Clock) Mode() string {
+	return c.mode
+}
+
+func (c *Clock) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := "stopped"
+	if c.running {
+		state = "running"
+	}
+	tempo := "tempo unknown"
+	if c.tempo > 0 {
+		tempo = fmt.Sprintf("%.1f BPM", c.tempo)
+	}
+	return fmt.Sprintf("clock: %s, %s, %s, dropped messages: %d", c.mode, state, tempo, c.dropped)
+}
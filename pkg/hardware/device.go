@@ -1,14 +1,17 @@
 package hardware
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
+	"time"
 )
 
 type KeyEvent struct {
 	device   *DeviceInfo // event source identifier
 	Code     uint8
 	Released bool
+	Time     time.Time // kernel timestamp of the event
 }
 
 func (ke KeyEvent) String() string {
@@ -21,7 +24,7 @@ func (ke KeyEvent) Source() string {
 }
 
 func NewEvent(device *DeviceInfo, code uint8, released bool) KeyEvent {
-	return KeyEvent{device, code, released}
+	return KeyEvent{device, code, released, time.Now()}
 }
 
 type Handler struct {
@@ -33,6 +36,10 @@ func NewHandler(fd *os.File, device DeviceInfo) Handler {
 	return Handler{Fd: fd, Device: device}
 }
 
+func (h Handler) Info() DeviceInfo {
+	return h.Device
+}
+
 // kind of reverse engineering because too lazy to understand linux's input.h events structure
 func (h Handler) ReadKey() (KeyEvent, error) {
 	// at least 24.byte, full 3-part event data
@@ -64,5 +71,12 @@ func (h Handler) ReadKey() (KeyEvent, error) {
 		panic("Ultimate Shiet 6k")
 	}
 
-	return NewEvent(&h.Device, event[2], released), nil
+	// first part is the timestamp, seconds and microseconds (64bit each)
+	seconds := int64(binary.LittleEndian.Uint64(buf[0:8]))
+	microseconds := int64(binary.LittleEndian.Uint64(buf[8:16]))
+
+	keyEvent := NewEvent(&h.Device, event[2], released)
+	keyEvent.Time = time.Unix(seconds, microseconds*int64(time.Microsecond))
+
+	return keyEvent, nil
 }
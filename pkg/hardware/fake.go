@@ -0,0 +1,62 @@
+package hardware
+
+import (
+	"io"
+	"time"
+)
+
+// KeySource delivers key events of a single keyboard device
+type KeySource interface {
+	ReadKey() (KeyEvent, error)
+	Info() DeviceInfo
+}
+
+// FakeSource is a scripted keyboard, e.g. for golden tests or headless runs without input devices
+type FakeSource struct {
+	device DeviceInfo
+	events chan KeyEvent
+}
+
+func NewFakeSource(name string) *FakeSource {
+	return &FakeSource{device: DeviceInfo{Name: name}, events: make(chan KeyEvent, 256)}
+}
+
+func (f *FakeSource) Press(code uint8) {
+	f.events <- NewEvent(&f.device, code, false)
+}
+
+func (f *FakeSource) Release(code uint8) {
+	f.events <- NewEvent(&f.device, code, true)
+}
+
+// PressAt and ReleaseAt send events with given timestamp, e.g. for hold durations without waiting
+func (f *FakeSource) PressAt(code uint8, at time.Time) {
+	f.events <- KeyEvent{&f.device, code, false, at}
+}
+
+func (f *FakeSource) ReleaseAt(code uint8, at time.Time) {
+	f.events <- KeyEvent{&f.device, code, true, at}
+}
+
+// Tap presses and releases key
+func (f *FakeSource) Tap(code uint8) {
+	f.Press(code)
+	f.Release(code)
+}
+
+// Close ends the stream, ReadKey returns io.EOF once queued events are read
+func (f *FakeSource) Close() {
+	close(f.events)
+}
+
+func (f *FakeSource) ReadKey() (KeyEvent, error) {
+	event, ok := <-f.events
+	if !ok {
+		return KeyEvent{}, io.EOF
+	}
+	return event, nil
+}
+
+func (f *FakeSource) Info() DeviceInfo {
+	return f.device
+}
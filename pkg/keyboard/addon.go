@@ -1,7 +1,6 @@
 package keyboard
 
 import (
-	"github.com/xthexder/go-jack"
 	"keyboard3000/pkg/logging"
 	"os"
 	"strconv"
@@ -53,6 +52,9 @@ var resetted bool = true
 
 // todo: fix implementation
 func (d *MidiDevice) handleCompleteData(data string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	values := strings.Split(data, ",")
 	if len(values) == 4 { // make sure there is as many values as I expected
 		if d.pitchControl && time.Since(last_sig) > 10*time.Millisecond {
@@ -70,33 +72,24 @@ func (d *MidiDevice) handleCompleteData(data string) {
 				global_z = 0.0
 			}
 
-			*d.events <- MidiEvent{
-				d.MidiPort,
-				jack.MidiData{
-					0,
-					[]byte{
-						MidiPitchControl | d.channel,
-
-						byte(int(global_z) & 0x7f),
-						byte((int(global_z) >> 7) & 0x7f),
-					},
-				},
+			d.sendPitchBend(uint16(global_z))
+
+			if d.mpe != nil { // per-note pressure makes sense only with per-note channels
+				if global_y > 16383.0 {
+					global_y = 16383
+				} else if global_y < 0.0 {
+					global_y = 0.0
+				}
+				d.sendPressure(uint8(int(global_y) >> 7))
 			}
 
 			logging.Infof("Z: %8.2f", global_z)
 			resetted = false
 			last_sig = time.Now()
 		} else if !d.pitchControl && !resetted {
-			*d.events <- MidiEvent{
-				d.MidiPort,
-				jack.MidiData{
-					0,
-					[]byte{
-						MidiPitchControl | d.channel,
-						byte(0),
-						byte(8192>>7) & 0x7f,
-					},
-				},
+			d.sendPitchBend(8192)
+			if d.mpe != nil {
+				d.sendPressure(0)
 			}
 			global_x = 8192.0
 			global_y = 8192.0
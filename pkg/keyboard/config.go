@@ -2,9 +2,12 @@ package keyboard
 
 import (
 	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"keyboard3000/pkg/logging"
+	"strconv"
+	"strings"
 )
 
 var configNotFoundError = errors.New("shiet, Config not founded")
@@ -21,16 +24,214 @@ type Identification struct {
 }
 
 type Options struct {
-	MidiJamMode string `yaml:"midi_jam_mode"`
+	MidiJamMode  string  `yaml:"midi_jam_mode"`
+	ProgramNames string  `yaml:"program_names"` // "gm" or path to MIDNAM file
+	Tempo        float64 `yaml:"tempo"`         // BPM for note division based durations, 120 if not set
+}
+
+// additional voice played with every note, e.g. strings on top of piano or octave doubling
+type LayerConfig struct {
+	Channel       *uint8  `yaml:"channel"`        // zone channel is followed if not set
+	Transpose     int8    `yaml:"transpose"`      // semitones, relative to zone transposition
+	VelocityScale float64 `yaml:"velocity_scale"` // 1.0 if not set
+}
+
+// polyphony limit with voice stealing
+type PolyphonyConfig struct {
+	Max   int    `yaml:"max"`   // max sounding notes, unlimited if not set
+	Steal string `yaml:"steal"` // "oldest" (default), "lowest" or "highest"
+}
+
+// keyboard split, keys are matched first by key codes and then by mapped notes range
+type ZoneConfig struct {
+	Name        string   `yaml:"name"`
+	Keys        []uint8  `yaml:"keys"`
+	Notes       string   `yaml:"notes"` // "36-59", inclusive
+	Channel     uint8    `yaml:"channel"`
+	Transpose   int8     `yaml:"transpose"`
+	Velocity    uint8    `yaml:"velocity"` // 0 - random
+	Output      string   `yaml:"output"`   // additional output port, device's main port is used if empty
+	AutoConnect []string `yaml:"auto_connect"`
+
+	Layers    []LayerConfig    `yaml:"layers"`
+	Polyphony *PolyphonyConfig `yaml:"polyphony"`
+}
+
+// MPE output mode, lower zone uses channel 0 as manager and following channels as members,
+// upper zone uses channel 15 as manager and preceding channels as members
+type MpeConfig struct {
+	Zone           string `yaml:"zone"`             // "lower" (default) or "upper"
+	Members        uint8  `yaml:"members"`          // 1-15
+	PitchBendRange uint8  `yaml:"pitch_bend_range"` // member channels range in semitones, 48 if not set
+}
+
+// Scala scale file with optional keyboard mapping
+type TuningFile struct {
+	Scale   string `yaml:"scl"`
+	Mapping string `yaml:"kbm"` // linear mapping from middle C with A4 = 440Hz if not set
+}
+
+// microtonal tunings, realized by MIDI Tuning Standard SysEx or per-note pitch bend
+type TuningConfig struct {
+	Method         string       `yaml:"method"`           // "mts_bulk" (default), "mts_single" or "pitch_bend"
+	PitchBendRange uint8        `yaml:"pitch_bend_range"` // pitch bend method only, semitones, 2 if not set
+	Channels       []uint8      `yaml:"channels"`         // pitch bend method rotation channels, all if not set
+	Files          []TuningFile `yaml:"files"`
+}
+
+// isomorphic layout, generates notes from physical rows instead of enumerating every key
+type LayoutConfig struct {
+	Type           string    `yaml:"type"`            // "wicki_hayden", "janko", "accordion_b", "accordion_c", "harmonic_table" or "custom"
+	Rows           [][]uint8 `yaml:"rows"`            // key codes of every physical row, from the top one, left to right
+	RowOffsets     []int     `yaml:"row_offsets"`     // optional column shift of every row, for unusual staggers
+	BaseNote       uint8     `yaml:"base_note"`       // note of the first not offset key of the bottom row (column 0)
+	ColumnInterval int       `yaml:"column_interval"` // custom layout only, semitones to the next key in a row
+	RowInterval    int       `yaml:"row_interval"`    // custom layout only, semitones to the upper-left key
+}
+
+// monophonic mode, enabled from the beginning if configured, "mono_toggle" control switches it
+type MonoConfig struct {
+	Priority string `yaml:"priority"` // "last" (default), "low" or "high"
+	Legato   bool   `yaml:"legato"`   // note_on before note_off of previous note, retrigger otherwise
+}
+
+// key-driven pitch bend ("bend_up"/"bend_down" controls), glides to target while held and springs back on release
+type BendConfig struct {
+	Range   float64 `yaml:"range"`      // synth pitch bend range in semitones, 2 if not set
+	Amount  float64 `yaml:"amount"`     // bend target in semitones, full range if not set
+	Attack  int     `yaml:"attack_ms"`  // glide time to target
+	Release int     `yaml:"release_ms"` // spring back time
+}
+
+// key-driven modulation ("mod_up"/"mod_down"/"mod_hold" controls), ramps CC1 while held
+type ModulationConfig struct {
+	Time int `yaml:"time_ms"` // full range ramp time, 500ms if not set
+}
+
+// alternate notes/control map, active while shift key is held (or toggled), keys missing in the shift layer
+// fall through to the base map
+type ShiftConfig struct {
+	Name    string           `yaml:"name"`
+	Key     string           `yaml:"key"`  // key name (e.g. "alt", "ralt", "caps") or event code
+	Mode    string           `yaml:"mode"` // "hold" (default) or "toggle"
+	Notes   map[uint8]uint8  `yaml:"notes"`
+	Control map[uint8]string `yaml:"control"`
+}
+
+// gesture key, different controls for tap, long press and double tap
+type GestureConfig struct {
+	OnTap    string `yaml:"tap"`
+	OnLong   string `yaml:"long"`
+	OnDouble string `yaml:"double"`
+	Long     int    `yaml:"long_ms"`   // min hold duration of long press, 500ms if not set
+	Double   int    `yaml:"double_ms"` // max pause between taps of double tap, 300ms if not set
+}
+
+// note release behaviour, release velocity is fixed or derived from hold duration if hold is set
+type ReleaseConfig struct {
+	Style    string             `yaml:"style"`    // "note_off" (default, 0x80) or "note_on" (0x90 with velocity 0)
+	Velocity uint8              `yaml:"velocity"` // fixed release velocity, 0 if not set, the slowest one with hold
+	Hold     *HoldReleaseConfig `yaml:"hold"`
+}
+
+// release velocity falls linearly from 127 (short hold) to the configured velocity (long hold)
+type HoldReleaseConfig struct {
+	Short int `yaml:"short_ms"` // 100ms if not set
+	Long  int `yaml:"long_ms"`  // 2000ms if not set
+}
+
+// one-shot key, note_off is sent automatically after fixed duration, key release is ignored
+type OneShotConfig struct {
+	Note     uint8  `yaml:"note"`
+	Duration int    `yaml:"duration_ms"`
+	Division string `yaml:"division"` // note division at device tempo, e.g. "1/16", "1/8." (dotted) or "1/4t" (triplet)
+}
+
+// macro step, sends raw midi messages (hex bytes or SysEx file) after optional delay
+type MacroStepConfig struct {
+	Send  string `yaml:"send"`     // hex bytes, e.g. "b0 07 64", several messages are allowed
+	Syx   string `yaml:"syx"`      // path to .syx file, may contain several SysEx messages
+	Delay int    `yaml:"delay_ms"` // pause before messages of the step
+}
+
+// Standard MIDI File played with "play <name>", "loop <name>" and "stop <name>" controls
+type PlaybackConfig struct {
+	File       string          `yaml:"file"`
+	TempoScale float64         `yaml:"tempo_scale"` // 1.0 if not set, 2.0 plays twice as fast
+	Channels   map[uint8]uint8 `yaml:"channels"`    // channel remapping, file channel: output channel
+}
+
+// phrase looper, "looper" control arms it, first played event starts recording
+type LooperConfig struct {
+	Bars        int `yaml:"bars"`          // loop length at options tempo, set by second "looper" press if not set
+	BeatsPerBar int `yaml:"beats_per_bar"` // 4 if not set
+}
+
+// step sequencer, "sequencer" control switches device keys to step grid
+type SequencerConfig struct {
+	Steps    int     `yaml:"steps"`     // pattern length, 16 if not set
+	Tempo    float64 `yaml:"tempo"`     // options tempo if not set
+	Swing    int     `yaml:"swing"`     // 0-50, delay of every second step in percent of step length
+	Velocity uint8   `yaml:"velocity"`  // velocity of newly set steps, 100 if not set
+	Gate     int     `yaml:"gate"`      // gate of newly set steps in percent of step length, 50 if not set
+	Lanes    []uint8 `yaml:"lanes"`     // note of every lane, e.g. kick, snare, hi-hat
+	File     string  `yaml:"file"`      // pattern file, loaded at start if exists
+	StepKeys []uint8 `yaml:"step_keys"` // 1-8 and q-i keys (2x8 grid) if not set, one page of steps
+	LaneKeys []uint8 `yaml:"lane_keys"` // a-k keys if not set
+	PageKeys []uint8 `yaml:"page_keys"` // z-v keys if not set
+}
+
+// sequencer pattern file
+type PatternConfig struct {
+	Steps int                 `yaml:"steps"`
+	Tempo float64             `yaml:"tempo,omitempty"`
+	Swing int                 `yaml:"swing"`
+	Lanes []PatternLaneConfig `yaml:"lanes"`
+}
+
+type PatternLaneConfig struct {
+	Note  uint8               `yaml:"note"`
+	Steps []PatternStepConfig `yaml:"steps,flow"`
+}
+
+type PatternStepConfig struct {
+	Step     int   `yaml:"step"` // 1-based
+	Velocity uint8 `yaml:"velocity"`
+	Gate     int   `yaml:"gate"`
+}
+
+// transport and midi clock output of the device, driven by shared clock (see -clock flag)
+type ClockConfig struct {
+	Send    bool     `yaml:"send"`    // midi clock ticks are sent as well, transport messages only otherwise
+	Outputs []string `yaml:"outputs"` // zone outputs receiving clock messages, main port if not set
 }
 
 // configuration yaml structure
 type ConfigStruct struct {
-	Identification Identification   `yaml:"identification"`
-	Control        map[uint8]string `yaml:"control"`
-	Notes          map[uint8]uint8  `yaml:"notes"`
-	Options        Options          `yaml:"options"`
-	AutoConnect    []string         `yaml:"auto_connect"`
+	Identification Identification               `yaml:"identification"`
+	Control        map[uint8]string             `yaml:"control"`
+	Notes          map[uint8]uint8              `yaml:"notes"`
+	OneShots       map[uint8]OneShotConfig      `yaml:"one_shots"`
+	Macros         map[string][]MacroStepConfig `yaml:"macros"` // bound with "macro <name>" control
+	Playbacks      map[string]PlaybackConfig    `yaml:"playback"`
+	Layout         *LayoutConfig                `yaml:"layout"`
+	Zones          []ZoneConfig                 `yaml:"zones"`
+	Layers         []LayerConfig                `yaml:"layers"` // layers of keys not covered by zones
+	Mpe            *MpeConfig                   `yaml:"mpe"`
+	Tuning         *TuningConfig                `yaml:"tuning"`
+	Mono           *MonoConfig                  `yaml:"mono"`
+	Polyphony      *PolyphonyConfig             `yaml:"polyphony"`
+	Bend           BendConfig                   `yaml:"bend"`
+	Modulation     ModulationConfig             `yaml:"modulation"`
+	Release        ReleaseConfig                `yaml:"release"`
+	Looper         LooperConfig                 `yaml:"looper"`
+	Sequencer      *SequencerConfig             `yaml:"sequencer"`
+	Clock          *ClockConfig                 `yaml:"clock"`
+	Shifts         []ShiftConfig                `yaml:"shifts"`
+	Combos         map[string]string            `yaml:"combos"` // e.g. "ctrl+up": "octave_up"
+	Gestures       map[uint8]GestureConfig      `yaml:"gestures"`
+	Options        Options                      `yaml:"options"`
+	AutoConnect    []string                     `yaml:"auto_connect"`
 }
 
 var stringToConst = map[string]uint8{
@@ -48,6 +249,105 @@ var stringToConst = map[string]uint8{
 	"octave_del":           OctaveDel,
 	"pitch_control":        PitchControl,
 	"pitch_control_toggle": PitchControlToggle,
+	"bank_up":              BankUp,
+	"bank_down":            BankDown,
+	"layer_toggle":         LayerToggle,
+	"latch_toggle":         LatchToggle,
+	"latch_release":        LatchRelease,
+	"tuning_next":          TuningNext,
+	"tuning_prev":          TuningPrev,
+	"mono_toggle":          MonoToggle,
+	"bend_up":              BendUp,
+	"bend_down":            BendDown,
+	"mod_up":               ModUp,
+	"mod_down":             ModDown,
+	"mod_hold":             ModHold,
+	"record_toggle":        RecordToggle,
+	"looper":               LooperPress,
+	"looper_stop":          LooperStop,
+	"looper_undo":          LooperUndo,
+	"looper_clear":         LooperClear,
+	"sequencer":            SequencerToggle,
+	"seq_play":             SequencerPlay,
+	"seq_tempo_up":         SequencerTempoUp,
+	"seq_tempo_down":       SequencerTempoDown,
+	"seq_swing_up":         SequencerSwingUp,
+	"seq_swing_down":       SequencerSwingDown,
+	"seq_velocity_up":      SequencerVelocityUp,
+	"seq_velocity_down":    SequencerVelocityDown,
+	"seq_gate_up":          SequencerGateUp,
+	"seq_gate_down":        SequencerGateDown,
+	"seq_clear":            SequencerClear,
+	"seq_save":             SequencerSave,
+	"seq_load":             SequencerLoad,
+	"transport_start":      TransportStart,
+	"transport_stop":       TransportStop,
+	"transport_continue":   TransportContinue,
+	"tap_tempo":            TapTempo,
+}
+
+// control targets which require a value, e.g. "program 17"
+var parametrizedStringToConst = map[string]struct {
+	target uint8
+	max    int
+}{
+	"program": {ProgramSet, 127},
+	"bank":    {BankSet, 16383},
+	"tuning":  {TuningSet, 127},
+}
+
+// playback control targets, given with playback name, e.g. "loop drums"
+var playbackStringToConst = map[string]uint8{
+	"play": PlaybackPlay,
+	"loop": PlaybackLoop,
+	"stop": PlaybackStop,
+}
+
+// parses control binding, e.g. "octave_up", "program 17", "macro scene_a", "play drums"
+// or "octave_up @bass" for zone targeted controls
+func parseControl(control string) (keyBind, error) {
+	bind := keyBind{bindType: Control}
+
+	fields := strings.Fields(control)
+	if len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "@") {
+		bind.zone = fields[len(fields)-1][1:]
+		fields = fields[:len(fields)-1]
+	}
+
+	switch len(fields) {
+	case 1:
+		bind.target = stringToConst[fields[0]]
+		return bind, nil
+	case 2:
+	default:
+		return keyBind{}, fmt.Errorf("invalid control \"%s\"", control)
+	}
+
+	if fields[0] == "macro" {
+		bind.target = MacroRun
+		bind.macro = fields[1]
+		return bind, nil
+	}
+
+	if target, ok := playbackStringToConst[fields[0]]; ok {
+		bind.target = target
+		bind.playback = fields[1]
+		return bind, nil
+	}
+
+	parametrized, ok := parametrizedStringToConst[fields[0]]
+	if !ok {
+		return keyBind{}, fmt.Errorf("unknown control \"%s\"", control)
+	}
+
+	value, err := strconv.Atoi(fields[1])
+	if err != nil || value < 0 || value > parametrized.max {
+		return keyBind{}, fmt.Errorf("\"%s\" value should be in 0-%d range", control, parametrized.max)
+	}
+
+	bind.target = parametrized.target
+	bind.value = value
+	return bind, nil
 }
 
 func (c *ConfigStruct) setDefaults() {
@@ -67,7 +367,7 @@ func FindConfig(name string) (ConfigStruct, error) {
 			panic(err)
 		}
 
-		config, err := loadConfig(data)
+		config, err := LoadConfig(data)
 		if err != nil {
 			panic(err)
 		}
@@ -80,7 +380,8 @@ func FindConfig(name string) (ConfigStruct, error) {
 	return ConfigStruct{}, configNotFoundError
 }
 
-func loadConfig(data []byte) (ConfigStruct, error) {
+// LoadConfig parses map file content
+func LoadConfig(data []byte) (ConfigStruct, error) {
 	var config ConfigStruct
 	config.setDefaults()
 
@@ -88,6 +389,11 @@ func loadConfig(data []byte) (ConfigStruct, error) {
 	if err != nil {
 		return ConfigStruct{}, err
 	}
+
+	err = config.generateLayout()
+	if err != nil {
+		return ConfigStruct{}, err
+	}
 	return config, nil
 
 }
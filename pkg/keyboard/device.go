@@ -2,26 +2,23 @@ package keyboard
 
 import (
 	"fmt"
-	"github.com/xthexder/go-jack"
 	"io/ioutil"
+	"keyboard3000/pkg/clock"
 	"keyboard3000/pkg/hardware"
 	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
 	"keyboard3000/pkg/modifiers"
+	"keyboard3000/pkg/sink"
 	"math/rand"
+	"sync"
+	"time"
 )
 
 const (
-	//  channel info are in first byte and last four bits
-	MidiNoteOn         uint8 = 0x90 // first byte, first four bit mask, should be mixed with channel bits (last four bits)`
-	MidiNoteOff        uint8 = 0x80
-	MidiControlAndMode uint8 = 0xb0
-	MidiProgramChange  uint8 = 0xc0
-	MidiPitchControl   uint8 = 0xe0
-
-	MidiPanic uint8 = 0x7b // all notes off (status bytes)
-
 	Note = iota
 	Control
+	OneShot
+	Gesture
 
 	PitchControl
 	PitchControlToggle
@@ -38,21 +35,106 @@ const (
 	ProgramDown
 	OctaveAdd
 	OctaveDel
+	BankUp
+	BankDown
+	ProgramSet // parametrized targets, e.g. "program 17"
+	BankSet
+	LayerToggle
+	LatchToggle
+	LatchRelease
+	TuningNext
+	TuningPrev
+	TuningSet
+	MonoToggle
+	BendUp
+	BendDown
+	ModUp
+	ModDown
+	ModHold
+	MacroRun
+	RecordToggle
+	PlaybackPlay
+	PlaybackLoop
+	PlaybackStop
+	LooperPress
+	LooperStop
+	LooperUndo
+	LooperClear
+	SequencerToggle
+	SequencerPlay
+	SequencerTempoUp
+	SequencerTempoDown
+	SequencerSwingUp
+	SequencerSwingDown
+	SequencerVelocityUp
+	SequencerVelocityDown
+	SequencerGateUp
+	SequencerGateDown
+	SequencerClear
+	SequencerSave
+	SequencerLoad
+	TransportStart
+	TransportStop
+	TransportContinue
+	TapTempo
 )
 
 type MidiDevice struct {
-	Handler *hardware.Handler
-	Config  ConfigStruct
+	Source hardware.KeySource // physical keyboard or fake one
+	Config ConfigStruct
+
+	mutex  sync.Mutex // device state is shared by key processing, timers and UI
+	closed bool
+
+	defaultZone *zone   // keys not covered by configured zones
+	zones       []*zone // configured zones, in config order
 
-	channel   uint8
-	semitones int8
-	program   uint8
+	programNames *ProgramNames
+	mpe          *mpe     // MPE mode, every note gets its own member channel
+	tunings      *tunings // microtonal tunings
 
 	keyMap      keyMap
 	pressedKeys pressedKeys
 
-	events   *chan MidiEvent
-	MidiPort *jack.Port
+	shifts []*shift // alternate key maps
+	shift  *shift   // active shift layer, nil for base key map
+	combos []combo  // key combinations bound to controls, e.g. "ctrl+up"
+
+	gestures map[uint8]*gesture // map[eventCode], tap/long press/double tap keys
+
+	held         map[uint8]bool     // every physically held key, mapped or not
+	pressedBinds map[uint8]boundKey // bindings resolved at key press, releases follow them after layer switch
+
+	latch   bool           // notes keep sounding after key release
+	latched map[uint8]bool // map[eventCode], released keys which notes are still in pressedKeys
+
+	mono *mono // monophonic mode, only one held key sounds
+
+	polyphony  polyphony // device polyphony limit, zones may have own limits
+	notesCount uint64    // sent note_on events counter
+
+	release release // note_off style and release velocity
+
+	ramps *ramps // key-driven pitch bend and modulation
+
+	oneShots map[uint8]oneShot // map[eventCode]
+	gates    []*gate           // sounding one-shot notes
+
+	macros map[string]macro
+
+	playbacks map[string]*playback // Standard MIDI Files played by "play", "loop" and "stop" controls
+
+	looper    *looper    // phrase looper, records device output
+	sequencer *sequencer // step sequencer, nil if not configured
+
+	events      *chan MidiEvent
+	eventTime   time.Time // kernel timestamp of key event being handled, zero for timer driven events
+	MidiPort    sink.Port
+	OutputPorts map[string]sink.Port // additional zone outputs, see Outputs()
+
+	OnRecordToggle func() // "record_toggle" control handler, recording is not a device thing
+
+	Clock *clock.Clock // shared tempo and transport, tempo of the device if known
 
 	modifiers []modifiers.Modifier
 
@@ -60,58 +142,242 @@ type MidiDevice struct {
 }
 
 // PressedKeys keeps track of keyboard button presses
-type pressedKeys map[uint8]map[uint8]uint8 // map[eventCode][Channel]MidiNote
+type pressedKeys map[uint8][]playedNote // map[eventCode][]playedNote
+
+// playedNote is a midi note sent out on key press, note_off should be sent to the same destination
+type playedNote struct {
+	zone    *zone // zone which played the note, not part of note destination
+	port    sink.Port
+	channel uint8
+	note    uint8
+	order   uint64    // note_on order, used by voice stealing
+	pressed time.Time // key event timestamp of note_on, used by hold derived release velocity
+}
+
+func (p playedNote) sameDestination(other playedNote) bool {
+	return p.port == other.port && p.channel == other.channel && p.note == other.note
+}
 
 type keyMap map[uint8]keyBind
 
 type MidiEvent struct {
-	Port *jack.Port
-	Data jack.MidiData
+	Port sink.Port
+	Data midi.Message
+	Time time.Time // key event timestamp, or send time of timer driven events
 }
 
 type keyBind struct {
 	target   uint8
 	bindType int
+	value    int    // parameter of parametrized control targets
+	macro    string // macro name of "macro" control
+	playback string // playback name of "play", "loop" and "stop" controls
+	zone     string // control target zone, empty for default zone
 }
 
-func New(handler *hardware.Handler, eventChan *chan MidiEvent) *MidiDevice {
-	config, err := FindConfig(handler.Device.Name)
+func New(source hardware.KeySource, eventChan *chan MidiEvent) *MidiDevice {
+	name := source.Info().Name
+
+	config, err := FindConfig(name)
 	if err != nil {
 		if err == configNotFoundError {
 			data, err := ioutil.ReadFile("./maps/default.yml")
 			if err != nil {
 				panic(err)
 			}
-			config, err = loadConfig(data)
+			config, err = LoadConfig(data)
 			logging.Infof(
 				"Shiet, configuration is missed for \"%s\" device, but default loaded at least ¯\\_(ツ )_/¯.",
-				handler.Device.Name,
+				name,
 			)
 		} else {
 			panic("semi-ultimate shiet occurred")
 		}
 	}
 
+	return NewWithConfig(source, config, eventChan)
+}
+
+// NewWithConfig creates device of given configuration, without looking for map files
+func NewWithConfig(source hardware.KeySource, config ConfigStruct, eventChan *chan MidiEvent) *MidiDevice {
 	keymap := make(keyMap)
 
 	for k, v := range config.Notes {
-		keymap[k] = keyBind{v, Note}
+		keymap[k] = keyBind{target: v, bindType: Note}
 	}
-	for k, v := range config.Control {
-		keymap[k] = keyBind{stringToConst[v], Control}
+
+	defaultLayers, err := newLayers(config.Layers)
+	if err != nil {
+		logging.Infof("Layers ignored: %s", err)
 	}
 
 	device := &MidiDevice{
-		Handler:     handler,
-		Config:      config,
-		keyMap:      keymap,
-		pressedKeys: make(pressedKeys),
-		events:      eventChan,
+		Source:       source,
+		Config:       config,
+		defaultZone:  &zone{layers: defaultLayers, layering: len(defaultLayers) > 0},
+		keyMap:       keymap,
+		pressedKeys:  make(pressedKeys),
+		held:         make(map[uint8]bool),
+		pressedBinds: make(map[uint8]boundKey),
+		latched:      make(map[uint8]bool),
+		mono:         &mono{priority: PriorityLast},
+		oneShots:     make(map[uint8]oneShot),
+		macros:       make(map[string]macro),
+		playbacks:    make(map[string]*playback),
+		events:       eventChan,
+		OutputPorts:  make(map[string]sink.Port),
+	}
+
+	for _, zoneConfig := range config.Zones {
+		z, err := newZone(zoneConfig)
+		if err != nil {
+			logging.Infof("Zone ignored: %s", err)
+			continue
+		}
+		device.zones = append(device.zones, z)
 	}
 
-	for _, v := range config.Control {
-		if v == "pitch_control" {
-			go device.pitchAddon()
+	for k, v := range config.OneShots {
+		shot, err := newOneShot(v)
+		if err != nil {
+			logging.Infof("One-shot binding of %d key ignored: %s", k, err)
+			continue
+		}
+		device.oneShots[k] = shot
+		keymap[k] = keyBind{target: shot.note, bindType: OneShot}
+	}
+
+	for name, steps := range config.Macros {
+		m, err := newMacro(steps)
+		if err != nil {
+			logging.Infof("Macro \"%s\" ignored: %s", name, err)
+			continue
+		}
+		device.macros[name] = m
+	}
+
+	for name, playbackConfig := range config.Playbacks {
+		p, err := newPlayback(playbackConfig)
+		if err != nil {
+			logging.Infof("Playback \"%s\" ignored: %s", name, err)
+			continue
+		}
+		device.playbacks[name] = p
+	}
+
+	device.bindControls(keymap, config.Control)
+
+	device.gestures = make(map[uint8]*gesture)
+	for k, v := range config.Gestures {
+		g, err := device.newGesture(v)
+		if err != nil {
+			logging.Infof("Gesture binding of %d key ignored: %s", k, err)
+			continue
+		}
+		device.gestures[k] = g
+		keymap[k] = keyBind{bindType: Gesture}
+	}
+
+	for _, shiftConfig := range config.Shifts {
+		s, err := device.newShift(shiftConfig)
+		if err != nil {
+			logging.Infof("Shift layer ignored: %s", err)
+			continue
+		}
+		device.shifts = append(device.shifts, s)
+	}
+
+	for name, control := range config.Combos {
+		c, err := device.newCombo(name, control)
+		if err != nil {
+			logging.Infof("Combo \"%s\" ignored: %s", name, err)
+			continue
+		}
+		device.combos = append(device.combos, c)
+	}
+
+	if config.Mpe != nil {
+		m, err := newMpe(*config.Mpe)
+		if err != nil {
+			logging.Infof("MPE mode disabled: %s", err)
+		} else {
+			device.mpe = m
+		}
+	}
+
+	if config.Polyphony != nil {
+		p, err := newPolyphony(*config.Polyphony)
+		if err != nil {
+			logging.Infof("Polyphony limit disabled: %s", err)
+		} else {
+			device.polyphony = p
+		}
+	}
+
+	if config.Sequencer != nil {
+		s, err := newSequencer(*config.Sequencer)
+		if err != nil {
+			logging.Infof("Sequencer disabled: %s", err)
+		} else {
+			device.sequencer = s
+		}
+	}
+
+	device.looper, err = newLooper(config.Looper)
+	if err != nil {
+		logging.Infof("Looper options ignored: %s", err)
+		device.looper, _ = newLooper(LooperConfig{})
+	}
+
+	device.release, err = newRelease(config.Release)
+	if err != nil {
+		logging.Infof("Release options ignored: %s", err)
+		device.release, _ = newRelease(ReleaseConfig{})
+	}
+
+	if config.Mono != nil {
+		m, err := newMono(*config.Mono)
+		if err != nil {
+			logging.Infof("Mono mode disabled: %s", err)
+		} else {
+			device.mono = m
+		}
+	}
+
+	if config.Tuning != nil {
+		t, err := newTunings(*config.Tuning)
+		if err != nil {
+			logging.Infof("Tunings disabled: %s", err)
+		} else {
+			device.tunings = t
+		}
+	}
+
+	if config.Options.ProgramNames != "" {
+		names, err := LoadProgramNames(config.Options.ProgramNames)
+		if err != nil {
+			logging.Infof("Failed to load program names from \"%s\": %s", config.Options.ProgramNames, err)
+		} else {
+			device.programNames = &names
+		}
+	}
+
+	var pitchAddon bool
+	for _, bind := range device.allBinds() {
+		if bind.bindType != Control {
+			continue
+		}
+		switch bind.target {
+		case PitchControl:
+			if !pitchAddon {
+				pitchAddon = true
+				go device.pitchAddon()
+			}
+		case BendUp, BendDown, ModUp, ModDown, ModHold:
+			if device.ramps == nil {
+				device.ramps = newRamps(config.Bend, config.Modulation)
+				go device.rampLoop()
+			}
 		}
 	}
 
@@ -119,64 +385,242 @@ func New(handler *hardware.Handler, eventChan *chan MidiEvent) *MidiDevice {
 }
 
 func (d *MidiDevice) Close() {
-	midiData := jack.MidiData{
-		Time:   0,
-		Buffer: []byte{MidiControlAndMode | d.channel, MidiPanic, 0x00},
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return
 	}
+	d.closed = true
 
-	*d.events <- MidiEvent{d.MidiPort, midiData}
+	if d.ramps != nil {
+		close(d.ramps.done)
+	}
+	for _, g := range d.gestures {
+		g.stopTimers()
+	}
+
+	d.allNotesOff(d.defaultZone)
+	for _, z := range d.zones {
+		d.allNotesOff(z)
+	}
 }
 
-func (d *MidiDevice) ChangeSemitone(value int) {
-	d.semitones += int8(value)
+// releases every note played by the zone (layers included) and sends all notes off on zone channels
+func (d *MidiDevice) allNotesOff(z *zone) {
+	d.closeGates(z)
+	d.stopPlaybacks(z)
+	if z == d.defaultZone {
+		d.stopLooper()
+		d.stopSequencer()
+	}
+
+	port := d.port(z)
+	channels := make(map[uint8]bool)
+	for _, channel := range z.channels() {
+		channels[channel] = true
+	}
+
+	var released []playedNote
+
+	for code, notes := range d.pressedKeys {
+		var kept []playedNote
+
+	Notes:
+		for _, played := range notes {
+			if played.zone != z {
+				kept = append(kept, played)
+				continue
+			}
+			channels[played.channel] = true
+			d.forget(played)
+
+			for _, other := range released {
+				if other.sameDestination(played) {
+					continue Notes
+				}
+			}
+			released = append(released, played)
+			d.noteOff(played)
+		}
+
+		if len(kept) == 0 {
+			delete(d.pressedKeys, code)
+		} else {
+			d.pressedKeys[code] = kept
+		}
+	}
+
+	d.mono.drop(z)
+	if d.mono.active && !d.keyHeld(d.mono.sounding) {
+		d.mono.active = false
+	}
+	for code := range d.latched {
+		if !d.keyHeld(code) {
+			delete(d.latched, code)
+		}
+	}
+
+	for channel := range channels {
+		message, err := midi.NewAllNotesOff(channel)
+		d.send(port, message, err)
+	}
 }
 
-func (d *MidiDevice) ChangeOctave(value int) {
-	d.semitones += 12 * int8(value)
+// releases resources held by played note, called once for every note removed from pressedKeys
+func (d *MidiDevice) forget(played playedNote) {
+	if pool := d.channelPool(); pool != nil {
+		pool.release(played.channel)
+	}
 }
 
-func (d *MidiDevice) ChangeChannel(value int) {
-	d.channel = (d.channel + uint8(value)) % 16
+// queues message for given port, invalid messages are dropped
+func (d *MidiDevice) send(port sink.Port, message midi.Message, err error) {
+	if err == nil {
+		err = message.Validate()
+	}
+	if err != nil {
+		logging.Infof("Invalid midi message dropped: %s", err)
+		return
+	}
+
+	at := d.now()
+	d.capture(port, message, at)
+	*d.events <- MidiEvent{port, message, at}
 }
 
-func (d *MidiDevice) ChangeProgram(value int) {
-	d.program += uint8(value)
+// timestamp of key event being handled, current time for timer driven events
+func (d *MidiDevice) now() time.Time {
+	if d.eventTime.IsZero() {
+		return time.Now()
+	}
+	return d.eventTime
+}
+
+func (d *MidiDevice) noteOn(played playedNote, velocity uint8) {
+	message, err := midi.NewNoteOn(played.channel, played.note, velocity)
+	d.send(played.port, message, err)
+}
 
-	midiData := jack.MidiData{
-		Time:   0,
-		Buffer: []byte{MidiProgramChange | d.channel, d.program, 0x00},
+func (d *MidiDevice) noteOff(played playedNote) {
+	if d.release.style == ReleaseNoteOn {
+		message, err := midi.NewNoteOn(played.channel, played.note, 0)
+		d.send(played.port, message, err)
+		return
 	}
 
-	*d.events <- MidiEvent{d.MidiPort, midiData}
+	velocity := d.release.velocityOf(d.now().Sub(played.pressed))
+	message, err := midi.NewNoteOff(played.channel, played.note, velocity)
+	d.send(played.port, message, err)
+}
+
+func (d *MidiDevice) ChangeSemitone(z *zone, value int) {
+	z.semitones += int8(value)
+}
+
+func (d *MidiDevice) ChangeOctave(z *zone, value int) {
+	z.semitones += 12 * int8(value)
+}
+
+func (d *MidiDevice) ChangeChannel(z *zone, value int) {
+	z.channel = uint8((int(z.channel) + value) & 0x0f)
+}
+
+func (d *MidiDevice) ChangeProgram(z *zone, value int) {
+	d.SetProgram(z, uint8((int(z.program)+value)&0x7f))
+}
+
+func (d *MidiDevice) SetProgram(z *zone, program uint8) {
+	z.program = program & 0x7f
+
+	message, err := midi.NewProgramChange(z.channel, z.program)
+	d.send(d.port(z), message, err)
+}
+
+func (d *MidiDevice) ChangeBank(z *zone, value int) {
+	d.SetBank(z, uint16((int(z.bank)+value)&0x3fff))
+}
+
+// selects bank (CC0 and CC32), bank change takes effect on synth after following program change
+func (d *MidiDevice) SetBank(z *zone, bank uint16) {
+	z.bank = bank & 0x3fff
+
+	message, err := midi.NewControlChange(z.channel, midi.BankSelectMSB, uint8(z.bank>>7))
+	d.send(d.port(z), message, err)
+	message, err = midi.NewControlChange(z.channel, midi.BankSelectLSB, uint8(z.bank&0x7f))
+	d.send(d.port(z), message, err)
+
+	d.SetProgram(z, z.program)
+}
+
+// returns "Bank 2 / 17: Warm Pad" like description of current zone program
+func (d *MidiDevice) ProgramDescription(z *zone) string {
+	bank := fmt.Sprintf("Bank %d", z.bank)
+	program := fmt.Sprintf("%3d", z.program)
+
+	if d.programNames != nil {
+		if name := d.programNames.BankName(z.bank); name != "" {
+			bank = fmt.Sprintf("%s (%s)", bank, name)
+		}
+		if name := d.programNames.ProgramName(z.bank, z.program); name != "" {
+			program = fmt.Sprintf("%s: %s", program, name)
+		}
+	}
+
+	return fmt.Sprintf("%s / %s", bank, program)
 }
 
 // main function responsible for processing raw hardware events to Midi
 func (d *MidiDevice) HandleRawEvent(event hardware.KeyEvent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	code := event.Code
 
+	d.eventTime = event.Time
+	defer func() { d.eventTime = time.Time{} }()
+
 	deviceName := d.Config.Identification.NiceName
 	if deviceName == "" {
 		deviceName = event.Source()
 	}
 
-	bind, ok := d.keyMap[code]
+	if event.Released {
+		delete(d.held, code)
+	} else {
+		d.held[code] = true
+	}
+
+	if d.handleShift(event) {
+		logging.Infof("%s  Device: %-20s [shift: %s]", event, deviceName, d.shiftName())
+		return
+	}
+
+	if d.handleSequencerKey(event) {
+		logging.Infof("%s  Device: %-20s [sequencer grid]", event, deviceName)
+		return
+	}
+
+	bound, ok := d.resolve(event)
 	if !ok {
 		logging.Infof("%s  Device: %-20s [config event not in map]", event, deviceName)
 		return
 	} else {
-		eventType, ok := d.Config.Control[code]
-		if !ok {
-			eventType = fmt.Sprintf("midi: %d", d.Config.Notes[code])
-		}
-
-		logging.Infof("%s  Device: %-20s [%s]", event, deviceName, eventType)
+		logging.Infof("%s  Device: %-20s [%s]", event, deviceName, bound.label)
 	}
+	bind := bound.bind
 
 	switch bind.bindType {
 	case Note:
 		d.handleNote(bind, event)
 	case Control:
 		d.handleControl(bind, event)
+	case OneShot:
+		if !event.Released {
+			d.triggerOneShot(code)
+		}
+	case Gesture:
+		d.handleGesture(code, event)
 	default:
 		panic("The Ultimatest Shiet I've ever seen")
 	}
@@ -190,36 +634,97 @@ func (d *MidiDevice) handleControl(bind keyBind, event hardware.KeyEvent) {
 		} else {
 			d.pitchControl = true
 		}
+	case BendUp, BendDown, ModUp, ModDown, ModHold: // held controls, releases matter
+		d.handleRamp(bind, event)
+		return
 	}
 
 	if event.Released {
 		return
 	}
 
+	z := d.zoneByName(bind.zone)
+
 	switch bind.target {
 	case OctaveUp:
-		d.ChangeOctave(1)
+		d.ChangeOctave(z, 1)
 	case OctaveDown:
-		d.ChangeOctave(-1)
+		d.ChangeOctave(z, -1)
 	case SemitoneUp:
-		d.ChangeSemitone(1)
+		d.ChangeSemitone(z, 1)
 	case SemitoneDown:
-		d.ChangeSemitone(-1)
+		d.ChangeSemitone(z, -1)
 	case ChannelUp:
-		d.ChangeChannel(1)
+		d.ChangeChannel(z, 1)
 	case ChannelDown:
-		d.ChangeChannel(-1)
+		d.ChangeChannel(z, -1)
 	case ProgramUp:
-		d.ChangeProgram(1)
+		d.ChangeProgram(z, 1)
 	case ProgramDown:
-		d.ChangeProgram(-1)
+		d.ChangeProgram(z, -1)
+	case ProgramSet:
+		d.SetProgram(z, uint8(bind.value))
+	case BankUp:
+		d.ChangeBank(z, 1)
+	case BankDown:
+		d.ChangeBank(z, -1)
+	case BankSet:
+		d.SetBank(z, uint16(bind.value))
 	case Panic:
-		midiData := jack.MidiData{
-			Time:   0,
-			Buffer: []byte{MidiControlAndMode | d.channel, MidiPanic, 0x00}, // panic,
+		d.allNotesOff(z)
+	case LayerToggle:
+		z.layering = !z.layering
+	case LatchToggle:
+		d.toggleLatch()
+	case LatchRelease:
+		d.releaseLatched()
+	case MonoToggle:
+		d.toggleMono()
+	case MacroRun:
+		d.runMacro(bind)
+	case PlaybackPlay:
+		d.startPlayback(bind, false)
+	case PlaybackLoop:
+		d.startPlayback(bind, true)
+	case PlaybackStop:
+		d.stopPlayback(d.playbacks[bind.playback])
+	case SequencerToggle, SequencerPlay, SequencerTempoUp, SequencerTempoDown, SequencerSwingUp, SequencerSwingDown,
+		SequencerVelocityUp, SequencerVelocityDown, SequencerGateUp, SequencerGateDown,
+		SequencerClear, SequencerSave, SequencerLoad:
+		if d.sequencer == nil {
+			logging.Info("Sequencer control ignored, sequencer is not configured")
+			return
+		}
+		d.handleSequencerControl(bind.target)
+	case TransportStart, TransportStop, TransportContinue, TapTempo:
+		d.handleTransport(bind.target)
+	case LooperPress:
+		d.looperPress()
+	case LooperStop:
+		d.stopLooper()
+	case LooperUndo:
+		d.undoLooper()
+	case LooperClear:
+		d.clearLooper()
+	case RecordToggle:
+		if d.OnRecordToggle == nil {
+			logging.Info("Record control ignored, recording is not available")
+			return
+		}
+		go d.OnRecordToggle() // may take a while to save the file
+	case TuningNext, TuningPrev, TuningSet:
+		if d.tunings == nil {
+			logging.Info("Tuning control ignored, no tunings configured")
+			return
+		}
+		switch bind.target {
+		case TuningNext:
+			d.ChangeTuning(1)
+		case TuningPrev:
+			d.ChangeTuning(-1)
+		case TuningSet:
+			d.SetTuning(bind.value)
 		}
-
-		*d.events <- MidiEvent{d.MidiPort, midiData}
 	case PitchControlToggle:
 		if d.pitchControl {
 			d.pitchControl = false
@@ -230,11 +735,12 @@ func (d *MidiDevice) handleControl(bind keyBind, event hardware.KeyEvent) {
 	}
 }
 
-func (d *MidiDevice) timesPressed(note uint8) int {
+// counts how many keys are holding given note on the same port and channel
+func (d *MidiDevice) timesPressed(played playedNote) int {
 	var presses int
-	for _, chMap := range d.pressedKeys {
-		for channel, pressedNote := range chMap {
-			if channel == d.channel && pressedNote == note {
+	for _, notes := range d.pressedKeys {
+		for _, pressed := range notes {
+			if pressed.sameDestination(played) {
 				presses += 1
 			}
 		}
@@ -242,89 +748,148 @@ func (d *MidiDevice) timesPressed(note uint8) int {
 	return presses
 }
 
-func (d *MidiDevice) handleNote(bind keyBind, event hardware.KeyEvent) {
-	var typeAndChannel byte
-	var velocity byte
-	var midiData jack.MidiData
+// sends note_off events for notes played by given key, respecting jam mode
+func (d *MidiDevice) releaseKey(code uint8) {
+	notes := d.pressedKeys[code]
+	delete(d.pressedKeys, code)
 
+	for _, played := range notes { // in fact there should not be more than one iteration in most cases
+		d.forget(played)
+
+		switch d.Config.Options.MidiJamMode {
+		case Always:
+		case Never, NewPressOnly:
+			if d.timesPressed(played) > 0 { // note is still held by different key
+				continue
+			}
+		default:
+			panic("unsupported")
+		}
+
+		d.noteOff(played)
+	}
+}
+
+func (d *MidiDevice) handleNote(bind keyBind, event hardware.KeyEvent) {
 	if event.Released {
-		for channel, note := range d.pressedKeys[event.Code] { // in fact there should not be more than one iteration in most cases
-			switch d.Config.Options.MidiJamMode {
-			case Always:
+		if d.latch {
+			if d.keyHeld(event.Code) {
+				d.latched[event.Code] = true
+			}
+			return
+		}
 
-				delete(d.pressedKeys, event.Code)
+		d.keyUp(event.Code)
 
-			case Never:
-				if d.timesPressed(note) > 1 {
-					delete(d.pressedKeys, event.Code)
+	} else {
+		if d.latched[event.Code] { // second press of latched key releases it
+			d.keyUp(event.Code)
+			return
+		}
 
-					return
-				}
-				delete(d.pressedKeys, event.Code)
+		if d.keyHeld(event.Code) { // key is already pressed
+			return
+		}
 
-			case NewPressOnly:
-				if d.timesPressed(note) > 1 {
-					delete(d.pressedKeys, event.Code)
+		velocity := d.velocity(d.zoneFor(event.Code, bind.target))
 
-					return
-				}
-				delete(d.pressedKeys, event.Code)
+		if d.monoMode() {
+			d.monoPress(event.Code, bind, velocity)
+			return
+		}
 
-			default:
-				panic("unsupported")
-			}
+		d.startKey(event.Code, bind, velocity)
+	}
 
-			typeAndChannel = MidiNoteOff | channel
-			velocity = 0
+}
 
-			midiData = jack.MidiData{
-				Time:   0,
-				Buffer: []byte{typeAndChannel, note, velocity},
-			}
-			*d.events <- MidiEvent{d.MidiPort, midiData}
+func (d *MidiDevice) velocity(z *zone) uint8 {
+	if z.velocity != 0 {
+		return z.velocity
+	}
+	return uint8(rand.Intn(63)) + 64
+}
 
-		}
+// returns true if key is pressed (or latched), even if it doesn't sound in mono mode
+func (d *MidiDevice) keyHeld(code uint8) bool {
+	if _, ok := d.pressedKeys[code]; ok {
+		return true
+	}
+	return d.monoMode() && d.mono.index(code) >= 0
+}
 
-	} else {
-		note := bind.target + uint8(d.semitones)
+// releases key, in mono mode previously held key may take over
+func (d *MidiDevice) keyUp(code uint8) {
+	delete(d.latched, code)
 
-		if _, ok := d.pressedKeys[event.Code]; !ok { // check if key was already pressed
-			d.pressedKeys[event.Code] = make(map[uint8]uint8)
-			d.pressedKeys[event.Code][d.channel] = note
-		} else {
-			if _, ok = d.pressedKeys[event.Code][d.channel]; !ok { // check if key was pressed on current channel
-				d.pressedKeys[event.Code][d.channel] = note // todo, check if code is reachable
+	if d.monoMode() {
+		d.monoRelease(code)
+		return
+	}
+	d.releaseKey(code)
+}
+
+// sends note_on events for every voice of given key and records them in pressedKeys
+func (d *MidiDevice) startKey(code uint8, bind keyBind, velocity uint8) {
+	z := d.zoneFor(code, bind.target)
+
+	for _, v := range d.voices(z, bind.target, velocity) { // every layer is recorded, so note_off events stay exact
+		var bend uint16
+		if d.tunings != nil {
+			if !d.tunings.mapped(v.played.note) {
+				continue
+			}
+			if d.tunings.method == TuningPitchBend {
+				v.played.note, bend = d.tunings.pitchBend(v.played.note, d.tuningBendRange())
 			}
 		}
 
+		pool := d.channelPool()
+
 		switch d.Config.Options.MidiJamMode {
 		case Always:
-			break
 		case NewPressOnly:
-			break
 		case Never:
-			if d.timesPressed(note) > 1 {
-				return
+			if pool == nil && d.timesPressed(v.played) > 0 { // note is already sounding, only recorded
+				d.pressedKeys[code] = append(d.pressedKeys[code], v.played)
+				continue
 			}
 		default:
 			panic("unsupported")
 		}
 
-		typeAndChannel = MidiNoteOn | d.channel
-		velocity = uint8(rand.Intn(63)) + 64
+		d.makeRoom(z) // voice stealing, before channel allocation, so stolen channel can be reused
 
-		midiData = jack.MidiData{
-			Time:   0,
-			Buffer: []byte{typeAndChannel, note, velocity},
+		if pool != nil {
+			v.played.channel = pool.allocate()
+			if d.mpe != nil {
+				d.mpe.latest = v.played
+			}
 		}
-		*d.events <- MidiEvent{d.MidiPort, midiData}
-	}
 
+		d.notesCount += 1
+		v.played.order = d.notesCount
+		d.pressedKeys[code] = append(d.pressedKeys[code], v.played)
+
+		if d.tunings != nil && d.tunings.method == TuningPitchBend {
+			d.pitchBendTo(v.played.port, v.played.channel, bend)
+		}
+		d.noteOn(v.played, v.velocity)
+	}
 }
 
 func (d *MidiDevice) Process() {
+	d.mutex.Lock()
+	if d.mpe != nil { // ports are ready at this point
+		d.setupMpe()
+	}
+	if d.tunings != nil {
+		d.retune()
+	}
+	d.mutex.Unlock()
+
 	for { // todo: exit on d.Close()
-		keyEvent, err := d.Handler.ReadKey()
+		keyEvent, err := d.Source.ReadKey()
 		if err != nil {
 			break
 		}
@@ -334,29 +899,55 @@ func (d *MidiDevice) Process() {
 
 func (m MidiEvent) String() string {
 	return fmt.Sprintf(
-		"MidiEvent, time: 0x%02x, data: [0x%02x, 0x%02x, 0x%02x]), port: \"%s\"",
-		m.Data.Time, m.Data.Buffer[0], m.Data.Buffer[1], m.Data.Buffer[2], m.Port.GetName(),
+		"MidiEvent, data: %s, port: \"%s\"",
+		m.Data, m.Port.Name(),
 	)
 }
 func (d *MidiDevice) String() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	deviceName := d.Config.Identification.NiceName
 	if deviceName == "" {
-		deviceName = d.Handler.Device.Name
+		deviceName = d.Source.Info().Name
 	}
 
-	var pressedKeys int
+	z := d.defaultZone
 
-	for _, chMap := range d.pressedKeys {
-		for channel := range chMap {
-			if channel == d.channel {
-				pressedKeys += 1
-			}
+	var zones string
+	for _, configured := range d.zones {
+		zones += fmt.Sprintf(", [%s]", configured)
+	}
+	if d.mpe != nil {
+		zones += fmt.Sprintf(", [%s]", d.mpe)
+	}
+	if d.latch {
+		zones += fmt.Sprintf(", [latch: %d]", len(d.latched))
+	}
+	if d.monoMode() {
+		zones += fmt.Sprintf(", [%s]", d.mono)
+	}
+	if d.shift != nil {
+		zones += fmt.Sprintf(", [%s]", d.shift)
+	}
+	if d.sequencer != nil {
+		zones += fmt.Sprintf(", [%s]", d.sequencerString())
+	}
+	if d.looper.state != LooperIdle {
+		zones += fmt.Sprintf(", [%s]", d.looper)
+	}
+	if d.polyphony.max > 0 {
+		zones += fmt.Sprintf(", [voices: %d/%s]", len(d.soundingNotes(nil)), d.polyphony)
+	}
+	if d.tunings != nil {
+		zones += fmt.Sprintf(", [%s]", d.tunings)
+		if d.mpe == nil && d.tunings.pool != nil {
+			zones += fmt.Sprintf(", [channels: %s]", d.tunings.pool)
 		}
-
 	}
 
 	return fmt.Sprintf(
-		"MidiDevice, channel: %2d, program: %2d, octaves: %2d (semitones: %2d), active keys: %d, [%s]",
-		d.channel, d.program, d.semitones/12, d.semitones%12, pressedKeys, deviceName,
+		"MidiDevice, channel: %2d, octaves: %2d (semitones: %2d), active keys: %d, %s%s, [%s]",
+		z.channel, z.semitones/12, z.semitones%12, len(d.pressedKeys), d.ProgramDescription(z), zones, deviceName,
 	)
 }
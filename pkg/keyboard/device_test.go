@@ -0,0 +1,215 @@
+package keyboard_test
+
+import (
+	"fmt"
+	"keyboard3000/pkg/hardware"
+	"keyboard3000/pkg/keyboard"
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/sink"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMap = `
+identification:
+  nice_name: "Test"
+control:
+  1: panic
+  60: octave_up
+  62: semitone_up
+notes:
+  44: 60
+  45: 60
+  46: 62
+options:
+  midi_jam_mode: "%s"
+`
+
+func TestMain(m *testing.M) {
+	go func() { // every key event is logged, terminal UI isn't there to read it
+		for range logging.LogMessages {
+		}
+	}()
+	os.Exit(m.Run())
+}
+
+// plays script through fake keyboard and returns messages which reached memory sink, note_on velocity is random,
+// so it's cut off
+func play(t *testing.T, configMap string, script func(source *hardware.FakeSource)) []string {
+	config, err := keyboard.LoadConfig([]byte(configMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan keyboard.MidiEvent, 1024)
+	source := hardware.NewFakeSource("test")
+	device := keyboard.NewWithConfig(source, config, &events)
+
+	memory := sink.NewMemory()
+	port, _ := memory.OpenPort("test")
+	device.MidiPort = port
+
+	script(source)
+	source.Close()
+	device.Process() // returns once every scripted event is handled
+	close(events)
+
+	for event := range events {
+		memory.Send(event.Port, event.Data, event.Time)
+	}
+
+	var messages []string
+	for _, message := range memory.Messages(port) {
+		if strings.HasPrefix(message, "note_on") {
+			message = message[:strings.LastIndex(message, " vel:")]
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestJamModes(t *testing.T) {
+	script := func(source *hardware.FakeSource) { // two keys of the same note
+		source.Press(44)
+		source.Press(45)
+		source.Release(44)
+		source.Release(45)
+	}
+
+	cases := map[string][]string{
+		"always": {
+			"note_on ch:0 note:60", "note_on ch:0 note:60", "note_off ch:0 note:60 vel:0", "note_off ch:0 note:60 vel:0",
+		},
+		"never": {
+			"note_on ch:0 note:60", "note_off ch:0 note:60 vel:0",
+		},
+		"new_presses_only": {
+			"note_on ch:0 note:60", "note_on ch:0 note:60", "note_off ch:0 note:60 vel:0",
+		},
+	}
+
+	for mode, expected := range cases {
+		if messages := play(t, fmt.Sprintf(testMap, mode), script); !reflect.DeepEqual(messages, expected) {
+			t.Errorf("%s: got %q, expected %q", mode, messages, expected)
+		}
+	}
+}
+
+func TestTransposition(t *testing.T) {
+	messages := play(t, fmt.Sprintf(testMap, "never"), func(source *hardware.FakeSource) {
+		source.Press(44)
+		source.Tap(60) // octave up, held note is released with its original pitch
+		source.Tap(62)
+		source.Release(44)
+		source.Tap(46)
+	})
+
+	expected := []string{
+		"note_on ch:0 note:60", "note_off ch:0 note:60 vel:0", "note_on ch:0 note:75", "note_off ch:0 note:75 vel:0",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	messages := play(t, fmt.Sprintf(testMap, "never"), func(source *hardware.FakeSource) {
+		source.Press(44)
+		source.Press(46)
+		source.Tap(1)
+		source.Release(44) // already released by panic
+		source.Release(46)
+	})
+
+	if len(messages) != 5 {
+		t.Fatalf("got %q, expected two notes, their note_off and all notes off", messages)
+	}
+	sort.Strings(messages[2:4]) // pressed keys are released in random order
+	expected := []string{
+		"note_on ch:0 note:60", "note_on ch:0 note:62",
+		"note_off ch:0 note:60 vel:0", "note_off ch:0 note:62 vel:0", "all_notes_off ch:0 value:0",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
+
+func TestMonoLegatoSameNote(t *testing.T) {
+	configMap := fmt.Sprintf(testMap, "always") + `
+mono:
+  legato: true
+`
+	messages := play(t, configMap, func(source *hardware.FakeSource) {
+		source.Press(44)
+		source.Press(45) // the same note, legato transition shouldn't cut it
+		source.Press(46)
+		source.Release(46)
+		source.Release(45)
+		source.Release(44)
+	})
+
+	expected := []string{
+		"note_on ch:0 note:60", "note_on ch:0 note:60", // second key takes over the note
+		"note_on ch:0 note:62", "note_off ch:0 note:60 vel:0",
+		"note_on ch:0 note:60", "note_off ch:0 note:62 vel:0", // back to the last held key
+		"note_on ch:0 note:60", // first key takes the note over again
+		"note_off ch:0 note:60 vel:0",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
+
+func TestPolyphonyOneShotGates(t *testing.T) {
+	configMap := fmt.Sprintf(testMap, "never") + `
+one_shots:
+  57:
+    note: 36
+    duration_ms: 60000
+polyphony:
+  max: 1
+`
+	messages := play(t, configMap, func(source *hardware.FakeSource) {
+		source.Tap(57)
+		source.Press(44) // open gate is stolen
+		source.Tap(57)   // and pressed key as well
+		source.Release(44)
+	})
+
+	expected := []string{
+		"note_on ch:0 note:36",
+		"note_off ch:0 note:36 vel:0", "note_on ch:0 note:60",
+		"note_off ch:0 note:60 vel:0", "note_on ch:0 note:36",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
+
+func TestReleaseVelocityOfHold(t *testing.T) {
+	configMap := fmt.Sprintf(testMap, "never") + `
+release:
+  velocity: 0
+  hold:
+    short_ms: 100
+    long_ms: 2000
+`
+	start := time.Now().Add(-time.Minute) // hold is measured between key events, not by handling time
+	messages := play(t, configMap, func(source *hardware.FakeSource) {
+		source.PressAt(44, start)
+		source.ReleaseAt(44, start.Add(50*time.Millisecond))
+		source.PressAt(46, start.Add(time.Second))
+		source.ReleaseAt(46, start.Add(4*time.Second))
+	})
+
+	expected := []string{
+		"note_on ch:0 note:60", "note_off ch:0 note:60 vel:127", "note_on ch:0 note:62", "note_off ch:0 note:62 vel:0",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
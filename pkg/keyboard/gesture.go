@@ -0,0 +1,141 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/hardware"
+	"keyboard3000/pkg/logging"
+	"time"
+)
+
+// gesture keys have different controls for tap, long press and double tap
+type gesture struct {
+	tap    *keyBind
+	long   *keyBind
+	double *keyBind
+
+	longTime   time.Duration // min hold duration of long press
+	doubleTime time.Duration // max pause between taps of double tap
+
+	// state machine
+	pressed    time.Time   // press timestamp, zero if key is not held
+	released   time.Time   // last tap release timestamp, zero if no tap is pending
+	consumed   bool        // current press already triggered its control (long press or double tap)
+	longTimer  *time.Timer // fires long press while key is held
+	tapTimer   *time.Timer // fires single tap when second tap doesn't come in time
+	generation uint64      // invalidates timers fired after state change
+}
+
+func (d *MidiDevice) newGesture(config GestureConfig) (*gesture, error) {
+	g := &gesture{
+		longTime:   time.Duration(config.Long) * time.Millisecond,
+		doubleTime: time.Duration(config.Double) * time.Millisecond,
+	}
+	if config.Long == 0 {
+		g.longTime = 500 * time.Millisecond
+	}
+	if config.Double == 0 {
+		g.doubleTime = 300 * time.Millisecond
+	}
+
+	for _, action := range []struct {
+		control string
+		bind    **keyBind
+	}{
+		{config.OnTap, &g.tap},
+		{config.OnLong, &g.long},
+		{config.OnDouble, &g.double},
+	} {
+		if action.control == "" {
+			continue
+		}
+		bind, err := d.parseBinding(action.control)
+		if err != nil {
+			return nil, err
+		}
+		*action.bind = &bind
+	}
+
+	if g.tap == nil && g.long == nil && g.double == nil {
+		return nil, fmt.Errorf("tap, long or double control expected")
+	}
+
+	return g, nil
+}
+
+// gesture state machine, only gesture keys get here so note keys are never delayed.
+// Single tap waits for double tap window only if double tap is configured
+func (d *MidiDevice) handleGesture(code uint8, event hardware.KeyEvent) {
+	g := d.gestures[code]
+
+	if !event.Released {
+		g.pressed, g.consumed = event.Time, false
+
+		if !g.released.IsZero() && event.Time.Sub(g.released) <= g.doubleTime { // second tap
+			g.stopTimers()
+			g.released, g.consumed = time.Time{}, true
+			d.fireGesture("double tap", g.double)
+			return
+		}
+
+		if g.long != nil {
+			generation := g.generation
+			g.longTimer = time.AfterFunc(g.longTime, func() {
+				d.mutex.Lock()
+				defer d.mutex.Unlock()
+				if d.closed || g.generation != generation || g.pressed.IsZero() {
+					return
+				}
+				g.consumed = true
+				d.fireGesture("long press", g.long)
+			})
+		}
+		return
+	}
+
+	if g.pressed.IsZero() { // key pressed before device was ready
+		return
+	}
+	held := event.Time.Sub(g.pressed)
+	g.pressed = time.Time{}
+	g.stopTimers()
+
+	switch {
+	case g.consumed:
+	case g.long != nil && held >= g.longTime: // long press timer didn't manage to fire yet
+		d.fireGesture("long press", g.long)
+	case g.double == nil:
+		d.fireGesture("tap", g.tap)
+	default:
+		g.released = event.Time
+		generation := g.generation
+		g.tapTimer = time.AfterFunc(g.doubleTime, func() {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			if d.closed || g.generation != generation {
+				return
+			}
+			g.released = time.Time{}
+			d.fireGesture("tap", g.tap)
+		})
+	}
+}
+
+func (g *gesture) stopTimers() {
+	g.generation += 1
+	for _, timer := range []*time.Timer{g.longTimer, g.tapTimer} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	g.longTimer, g.tapTimer = nil, nil
+}
+
+// triggers gesture control as a complete key press
+func (d *MidiDevice) fireGesture(kind string, bind *keyBind) {
+	if bind == nil {
+		return
+	}
+	logging.Infof("Gesture recognized: %s", kind)
+	d.handleControl(*bind, hardware.KeyEvent{Released: false})
+	d.handleControl(*bind, hardware.KeyEvent{Released: true})
+}
@@ -0,0 +1,16 @@
+package keyboard
+
+// toggles latch mode, disabling it releases every latched note
+func (d *MidiDevice) toggleLatch() {
+	d.latch = !d.latch
+	if !d.latch {
+		d.releaseLatched()
+	}
+}
+
+// releases notes of every latched key, keys which are physically held are kept
+func (d *MidiDevice) releaseLatched() {
+	for code := range d.latched {
+		d.keyUp(code)
+	}
+}
@@ -0,0 +1,122 @@
+package keyboard
+
+import (
+	"fmt"
+	"math"
+)
+
+// layer is an additional voice played together with every note of a zone, e.g. strings on top of piano
+type layer struct {
+	channel       uint8
+	sameChannel   bool // layer follows zone channel (e.g. octave doubling)
+	semitones     int8 // relative to zone transposition
+	velocityScale float64
+}
+
+// voice is a single note_on which should be sent for pressed key
+type voice struct {
+	played   playedNote
+	velocity uint8
+}
+
+func newLayer(config LayerConfig) (layer, error) {
+	l := layer{
+		sameChannel:   config.Channel == nil,
+		semitones:     config.Transpose,
+		velocityScale: config.VelocityScale,
+	}
+
+	if config.Channel != nil {
+		if *config.Channel > 15 {
+			return layer{}, fmt.Errorf("layer channel should be in 0-15 range")
+		}
+		l.channel = *config.Channel
+	}
+
+	if l.velocityScale == 0 {
+		l.velocityScale = 1.0
+	} else if l.velocityScale < 0 {
+		return layer{}, fmt.Errorf("layer velocity scale should be positive")
+	}
+
+	return l, nil
+}
+
+func newLayers(configs []LayerConfig) ([]layer, error) {
+	var layers []layer
+	for _, config := range configs {
+		l, err := newLayer(config)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+func (l layer) String() string {
+	if l.sameChannel {
+		return fmt.Sprintf("%+d", l.semitones)
+	}
+	return fmt.Sprintf("ch %d %+d", l.channel, l.semitones)
+}
+
+// returns all voices (zone note and enabled layers) which should be played for given mapped note
+func (d *MidiDevice) voices(z *zone, note uint8, velocity uint8) []voice {
+	var voices []voice
+
+	port := d.port(z)
+	now := d.now()
+
+	if transposed, ok := z.transpose(note); ok {
+		voices = append(voices, voice{playedNote{zone: z, port: port, channel: z.channel, note: transposed, pressed: now}, velocity})
+	}
+
+	if !z.layering {
+		return voices
+	}
+
+	for _, l := range z.layers {
+		transposed := int(note) + int(z.semitones) + int(l.semitones)
+		if transposed < 0 || transposed > 127 {
+			continue
+		}
+
+		channel := l.channel
+		if l.sameChannel {
+			channel = z.channel
+		}
+
+		scaled := int(math.Round(float64(velocity) * l.velocityScale))
+		if scaled < 1 {
+			scaled = 1
+		} else if scaled > 127 {
+			scaled = 127
+		}
+
+		voices = append(voices, voice{playedNote{zone: z, port: port, channel: channel, note: uint8(transposed), pressed: now}, uint8(scaled)})
+	}
+
+	return voices
+}
+
+// returns every channel zone can currently play on
+func (z *zone) channels() []uint8 {
+	channels := []uint8{z.channel}
+
+Layers:
+	for _, l := range z.layers {
+		channel := l.channel
+		if l.sameChannel {
+			channel = z.channel
+		}
+		for _, known := range channels {
+			if known == channel {
+				continue Layers
+			}
+		}
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
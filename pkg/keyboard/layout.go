@@ -0,0 +1,80 @@
+package keyboard
+
+import (
+	"fmt"
+)
+
+const (
+	LayoutWickiHayden   = "wicki_hayden"
+	LayoutJanko         = "janko"
+	LayoutAccordionB    = "accordion_b"
+	LayoutAccordionC    = "accordion_c"
+	LayoutHarmonicTable = "harmonic_table"
+	LayoutCustom        = "custom"
+)
+
+// intervals of isomorphic layouts, in semitones
+// column - to the next key in the same row
+// row - to the key above-left (key with the same index in the upper row on a staggered computer keyboard),
+// so interval to the key above-right is row + column
+var layoutIntervals = map[string]struct {
+	column int
+	row    int
+}{
+	LayoutWickiHayden:   {2, 5},  // whole tones along rows, fourths up-left, fifths up-right
+	LayoutJanko:         {2, -1}, // whole tones along rows, semitone shift between rows
+	LayoutAccordionB:    {3, -2}, // minor thirds along rows, semitones ascending up-right
+	LayoutAccordionC:    {3, 1},  // minor thirds along rows, semitones ascending up-left
+	LayoutHarmonicTable: {3, 4},  // minor thirds along rows, major thirds up-left, fifths up-right
+}
+
+// generates notes for keys described by layout, explicitly mapped notes are kept
+func (c *ConfigStruct) generateLayout() error {
+	layout := c.Layout
+	if layout == nil {
+		return nil
+	}
+
+	column, row := layout.ColumnInterval, layout.RowInterval
+	if layout.Type != LayoutCustom {
+		intervals, ok := layoutIntervals[layout.Type]
+		if !ok {
+			return fmt.Errorf("unknown layout type \"%s\"", layout.Type)
+		}
+		column, row = intervals.column, intervals.row
+	}
+
+	if len(layout.Rows) == 0 {
+		return fmt.Errorf("layout rows are not defined")
+	}
+	if len(layout.RowOffsets) != 0 && len(layout.RowOffsets) != len(layout.Rows) {
+		return fmt.Errorf("layout row offsets should be defined for every row")
+	}
+
+	if c.Notes == nil {
+		c.Notes = make(map[uint8]uint8)
+	}
+
+	for i, keys := range layout.Rows {
+		level := len(layout.Rows) - 1 - i // bottom row is the base one
+
+		offset := 0
+		if len(layout.RowOffsets) != 0 {
+			offset = layout.RowOffsets[i]
+		}
+
+		for j, code := range keys {
+			if _, ok := c.Notes[code]; ok {
+				continue
+			}
+
+			note := int(layout.BaseNote) + (j+offset)*column + level*row
+			if note < 0 || note > 127 {
+				continue
+			}
+			c.Notes[code] = uint8(note)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
+	"keyboard3000/pkg/sink"
+	"sort"
+	"time"
+)
+
+const (
+	LooperIdle      = iota
+	LooperArmed     // waits for the first played event
+	LooperRecording // first layer, loop length is not known yet
+	LooperPlaying
+	LooperOverdub // plays and records new layer
+	LooperStopped // content is kept, "looper" control plays it again
+)
+
+var looperStates = map[int]string{
+	LooperIdle:      "idle",
+	LooperArmed:     "armed",
+	LooperRecording: "recording",
+	LooperPlaying:   "playing",
+	LooperOverdub:   "overdub",
+	LooperStopped:   "stopped",
+}
+
+// looper records device output into layers and plays them in a loop
+type looper struct {
+	bars        int // loop length in bars at device tempo, set by second "looper" press if zero
+	beatsPerBar int
+
+	state  int
+	start  time.Time     // loop start, recorded offsets are relative to it
+	length time.Duration // zero until loop is closed
+	layers []*loopLayer  // first one is the base loop, every overdub adds one
+
+	stop       chan struct{} // closed when loop playback stops, nil if not playing
+	closeTimer *time.Timer   // closes first layer after configured bars
+	sounding   map[loopNote]bool
+}
+
+type loopLayer struct {
+	events  []loopEvent
+	removed bool // undone while its events were scheduled
+}
+
+type loopEvent struct {
+	offset  time.Duration
+	port    sink.Port
+	message midi.Message
+	layer   *loopLayer
+}
+
+type loopNote struct {
+	port    sink.Port
+	channel uint8
+	note    uint8
+}
+
+func newLooper(config LooperConfig) (*looper, error) {
+	l := &looper{bars: config.Bars, beatsPerBar: config.BeatsPerBar, sounding: make(map[loopNote]bool)}
+	if config.Bars < 0 || config.BeatsPerBar < 0 {
+		return nil, fmt.Errorf("bars and beats_per_bar should be positive")
+	}
+	if l.beatsPerBar == 0 {
+		l.beatsPerBar = 4
+	}
+	return l, nil
+}
+
+// "looper" control, arms looper, closes first layer or toggles overdub
+func (d *MidiDevice) looperPress() {
+	l := d.looper
+	now := time.Now()
+
+	switch l.state {
+	case LooperIdle:
+		l.state = LooperArmed
+	case LooperArmed:
+		l.state = LooperIdle
+	case LooperRecording:
+		if l.bars > 0 {
+			logging.Info("Looper closes the loop by itself after configured bars")
+			return
+		}
+		d.closeLoop(now.Sub(l.start))
+	case LooperPlaying:
+		l.layers = append(l.layers, &loopLayer{})
+		l.state = LooperOverdub
+	case LooperOverdub:
+		l.state = LooperPlaying
+	case LooperStopped:
+		// loop starts again right now, recorded offsets stay the same
+		l.start = now
+		d.startLoop(now)
+		l.state = LooperPlaying
+	}
+	logging.Infof("Looper %s", looperStates[l.state])
+}
+
+// closes the first layer, loop plays from this point and overdubs next layer
+func (d *MidiDevice) closeLoop(length time.Duration) {
+	l := d.looper
+	if length <= 0 {
+		return
+	}
+	l.length = length
+	l.layers = append(l.layers, &loopLayer{})
+	l.state = LooperOverdub
+	d.startLoop(l.start.Add(length))
+}
+
+// records device output, called for every sent message
+func (d *MidiDevice) capture(port sink.Port, message midi.Message, at time.Time) {
+	l := d.looper
+	if l == nil || !looperRecordable(message) {
+		return
+	}
+
+	switch l.state {
+	case LooperArmed:
+		l.state = LooperRecording
+		l.start = at
+		l.layers = []*loopLayer{{}}
+		logging.Infof("Looper %s", looperStates[l.state])
+
+		if l.bars > 0 {
+			beat := time.Duration(float64(time.Minute) / d.tempo())
+			length := beat * time.Duration(l.bars*l.beatsPerBar)
+			l.closeTimer = time.AfterFunc(length, func() {
+				d.mutex.Lock()
+				defer d.mutex.Unlock()
+				if d.closed || l.state != LooperRecording {
+					return
+				}
+				d.closeLoop(length)
+				logging.Infof("Looper %s", looperStates[l.state])
+			})
+		}
+	case LooperRecording, LooperOverdub:
+	default:
+		return
+	}
+
+	offset := at.Sub(l.start)
+	if l.length > 0 {
+		offset %= l.length
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	layer := l.layers[len(l.layers)-1]
+	layer.events = append(layer.events, loopEvent{offset, port, message, layer})
+}
+
+// only channel voice messages are looped, channel mode ones (e.g. all notes off of panic) are not
+func looperRecordable(message midi.Message) bool {
+	if _, ok := message.Channel(); !ok {
+		return false
+	}
+	return !(message.Status() == midi.ControlChange && message[1] >= midi.AllSoundOff)
+}
+
+func (d *MidiDevice) startLoop(cycle time.Time) {
+	l := d.looper
+	l.stop = make(chan struct{})
+	go d.runLoop(l.stop, cycle, l.length)
+}
+
+// plays every layer each cycle, layers recorded meanwhile are played from the next cycle
+func (d *MidiDevice) runLoop(stop chan struct{}, cycle time.Time, length time.Duration) {
+	l := d.looper
+
+	for ; ; cycle = cycle.Add(length) {
+		d.mutex.Lock()
+		events := l.events()
+		d.mutex.Unlock()
+
+		for _, event := range events {
+			if !d.waitPlayback(stop, cycle.Add(event.offset)) {
+				return
+			}
+			d.mutex.Lock()
+			if d.playbackStopped(stop) {
+				d.mutex.Unlock()
+				return
+			}
+			if !event.layer.removed {
+				l.play(d, event.port, event.message)
+			}
+			d.mutex.Unlock()
+		}
+
+		if !d.waitPlayback(stop, cycle.Add(length)) {
+			return
+		}
+		d.mutex.Lock()
+		if d.playbackStopped(stop) {
+			d.mutex.Unlock()
+			return
+		}
+		l.closeNotes(d) // notes hanging over the loop end would never be released otherwise
+		d.mutex.Unlock()
+	}
+}
+
+// events of every layer, in time order
+func (l *looper) events() []loopEvent {
+	var events []loopEvent
+	for _, layer := range l.layers {
+		events = append(events, layer.events...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].offset < events[j].offset })
+	return events
+}
+
+// loop events are validated already and shouldn't be recorded again, so they skip `send`
+func (l *looper) play(d *MidiDevice, port sink.Port, message midi.Message) {
+	channel, _ := message.Channel()
+
+	switch message.Status() {
+	case midi.NoteOn:
+		if message[2] > 0 {
+			l.sounding[loopNote{port, channel, message[1]}] = true
+		} else {
+			delete(l.sounding, loopNote{port, channel, message[1]})
+		}
+	case midi.NoteOff:
+		delete(l.sounding, loopNote{port, channel, message[1]})
+	}
+
+	*d.events <- MidiEvent{port, message, time.Now()}
+}
+
+func (l *looper) closeNotes(d *MidiDevice) {
+	for note := range l.sounding {
+		message, _ := midi.NewNoteOff(note.channel, note.note, 0)
+		*d.events <- MidiEvent{note.port, message, time.Now()}
+	}
+	l.sounding = make(map[loopNote]bool)
+}
+
+// "looper_stop" control, playing loop is kept, unfinished recording is dropped
+func (d *MidiDevice) stopLooper() {
+	l := d.looper
+
+	switch l.state {
+	case LooperArmed, LooperRecording:
+		d.clearLooper()
+		return
+	case LooperPlaying, LooperOverdub:
+		l.state = LooperStopped
+	}
+
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.closeNotes(d)
+}
+
+// "looper_undo" control, removes the last layer, undoing the base loop clears the looper
+func (d *MidiDevice) undoLooper() {
+	l := d.looper
+
+	if l.state == LooperOverdub && len(l.layers[len(l.layers)-1].events) == 0 { // nothing overdubbed yet
+		l.layers = l.layers[:len(l.layers)-1]
+	}
+	if l.length == 0 || len(l.layers) <= 1 {
+		d.clearLooper()
+		return
+	}
+
+	l.layers[len(l.layers)-1].removed = true
+	l.layers = l.layers[:len(l.layers)-1]
+	l.closeNotes(d)
+
+	if l.state == LooperOverdub { // overdub goes on with fresh layer
+		l.layers = append(l.layers, &loopLayer{})
+	}
+	logging.Infof("Looper layer removed, layers left: %d", len(l.layers))
+}
+
+// "looper_clear" control, stops the loop and forgets its content
+func (d *MidiDevice) clearLooper() {
+	l := d.looper
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	if l.closeTimer != nil {
+		l.closeTimer.Stop()
+		l.closeTimer = nil
+	}
+	l.closeNotes(d)
+
+	for _, layer := range l.layers {
+		layer.removed = true
+	}
+	l.layers = nil
+	l.length = 0
+	l.state = LooperIdle
+	logging.Info("Looper cleared")
+}
+
+func (l *looper) String() string {
+	if l.length == 0 {
+		return fmt.Sprintf("looper: %s", looperStates[l.state])
+	}
+	return fmt.Sprintf(
+		"looper: %s, %s, layers: %d", looperStates[l.state], l.length.Truncate(time.Millisecond), len(l.layers),
+	)
+}
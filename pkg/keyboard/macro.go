@@ -0,0 +1,98 @@
+package keyboard
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"keyboard3000/pkg/midi"
+	"strings"
+	"time"
+)
+
+// macro is a sequence of arbitrary midi messages with optional delays between them, e.g. patch dump or mixer scene
+type macro struct {
+	steps []macroStep
+}
+
+type macroStep struct {
+	messages []midi.Message
+	delay    time.Duration // pause before messages
+}
+
+func newMacro(config []MacroStepConfig) (macro, error) {
+	var m macro
+
+	for i, stepConfig := range config {
+		step, err := newMacroStep(stepConfig)
+		if err != nil {
+			return macro{}, fmt.Errorf("step %d: %s", i+1, err)
+		}
+		m.steps = append(m.steps, step)
+	}
+
+	if len(m.steps) == 0 {
+		return macro{}, fmt.Errorf("no steps defined")
+	}
+
+	return m, nil
+}
+
+func newMacroStep(config MacroStepConfig) (macroStep, error) {
+	step := macroStep{delay: time.Duration(config.Delay) * time.Millisecond}
+
+	if config.Delay < 0 {
+		return macroStep{}, fmt.Errorf("delay should not be negative")
+	}
+
+	var data []byte
+	switch {
+	case config.Send != "" && config.Syx != "":
+		return macroStep{}, fmt.Errorf("either send or syx is expected, not both")
+	case config.Send != "":
+		bytes, err := hex.DecodeString(strings.Join(strings.Fields(config.Send), ""))
+		if err != nil {
+			return macroStep{}, fmt.Errorf("invalid hex bytes \"%s\"", config.Send)
+		}
+		data = bytes
+	case config.Syx != "":
+		bytes, err := ioutil.ReadFile(config.Syx)
+		if err != nil {
+			return macroStep{}, err
+		}
+		data = bytes
+	case config.Delay == 0:
+		return macroStep{}, fmt.Errorf("send, syx or delay_ms is expected")
+	}
+
+	messages, err := midi.Parse(data)
+	if err != nil {
+		return macroStep{}, err
+	}
+	step.messages = messages
+
+	return step, nil
+}
+
+// sends macro messages to the zone port, delays are waited out in background so keys are not blocked
+func (d *MidiDevice) runMacro(bind keyBind) {
+	m := d.macros[bind.macro]
+	port := d.port(d.zoneByName(bind.zone))
+
+	go func() {
+		for _, step := range m.steps {
+			if step.delay > 0 {
+				time.Sleep(step.delay)
+			}
+
+			d.mutex.Lock()
+			if d.closed { // device removed in the middle of macro
+				d.mutex.Unlock()
+				return
+			}
+			for _, message := range step.messages {
+				d.send(port, message, nil)
+			}
+			d.mutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package keyboard
+
+import (
+	"fmt"
+)
+
+const (
+	PriorityLast = "last"
+	PriorityLow  = "low"
+	PriorityHigh = "high"
+)
+
+// mono keeps held keys in monophonic mode, only one of them sounds at a time
+type mono struct {
+	enabled  bool
+	priority string
+	legato   bool // new note_on is sent before note_off of previous note
+
+	held     []heldKey // in press order
+	sounding uint8     // event code of sounding key
+	active   bool      // some key is sounding
+}
+
+type heldKey struct {
+	code     uint8
+	bind     keyBind
+	zone     *zone
+	note     int // transposed note at press time, used for low/high priority
+	velocity uint8
+}
+
+func newMono(config MonoConfig) (*mono, error) {
+	m := &mono{enabled: true, priority: config.Priority, legato: config.Legato}
+
+	switch m.priority {
+	case "":
+		m.priority = PriorityLast
+	case PriorityLast, PriorityLow, PriorityHigh:
+	default:
+		return nil, fmt.Errorf("unknown note priority \"%s\"", config.Priority)
+	}
+
+	return m, nil
+}
+
+func (m *mono) index(code uint8) int {
+	for i, key := range m.held {
+		if key.code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns held key which should sound according to note priority
+func (m *mono) target() (heldKey, bool) {
+	if len(m.held) == 0 {
+		return heldKey{}, false
+	}
+
+	best := len(m.held) - 1
+	for i, key := range m.held {
+		switch m.priority {
+		case PriorityLow:
+			if key.note < m.held[best].note {
+				best = i
+			}
+		case PriorityHigh:
+			if key.note > m.held[best].note {
+				best = i
+			}
+		}
+	}
+
+	return m.held[best], true
+}
+
+// forgets held keys of given zone, e.g. after panic
+func (m *mono) drop(z *zone) {
+	var kept []heldKey
+	for _, key := range m.held {
+		if key.zone != z {
+			kept = append(kept, key)
+		}
+	}
+	m.held = kept
+}
+
+func (m *mono) String() string {
+	return fmt.Sprintf("mono %s, legato: %t, held: %d", m.priority, m.legato, len(m.held))
+}
+
+func (d *MidiDevice) monoPress(code uint8, bind keyBind, velocity uint8) {
+	z := d.zoneFor(code, bind.target)
+
+	d.mono.held = append(d.mono.held, heldKey{
+		code:     code,
+		bind:     bind,
+		zone:     z,
+		note:     int(bind.target) + int(z.semitones),
+		velocity: velocity,
+	})
+
+	d.monoUpdate()
+}
+
+func (d *MidiDevice) monoRelease(code uint8) {
+	i := d.mono.index(code)
+	if i < 0 { // key pressed before mono mode was enabled
+		d.releaseKey(code)
+		return
+	}
+	d.mono.held = append(d.mono.held[:i], d.mono.held[i+1:]...)
+
+	if d.mono.active && d.mono.sounding == code {
+		if _, ok := d.mono.target(); !ok {
+			d.mono.active = false
+			d.releaseKey(code)
+			return
+		}
+	}
+
+	d.monoUpdate()
+}
+
+// makes the key selected by note priority sound, previously sounding key is released
+func (d *MidiDevice) monoUpdate() {
+	target, ok := d.mono.target()
+	if !ok || (d.mono.active && d.mono.sounding == target.code) {
+		return
+	}
+
+	previous, hadPrevious := d.mono.sounding, d.mono.active
+
+	if hadPrevious && !d.mono.legato { // retrigger
+		d.releaseKey(previous)
+	}
+
+	d.startKey(target.code, target.bind, target.velocity)
+	d.mono.sounding, d.mono.active = target.code, true
+
+	if hadPrevious && d.mono.legato {
+		d.releaseLegato(previous)
+	}
+}
+
+// releases previous key after legato transition, notes played by the new key as well keep sounding,
+// even in "always" jam mode, note_off would cut note_on sent just before
+func (d *MidiDevice) releaseLegato(previous uint8) {
+	notes := d.pressedKeys[previous]
+	delete(d.pressedKeys, previous)
+
+	for _, played := range notes {
+		d.forget(played)
+		if d.timesPressed(played) > 0 {
+			continue
+		}
+		d.noteOff(played)
+	}
+}
+
+func (d *MidiDevice) monoMode() bool {
+	return d.mono.enabled
+}
+
+// toggles mono mode, sounding key is kept and released normally
+func (d *MidiDevice) toggleMono() {
+	d.mono.enabled = !d.mono.enabled
+	d.mono.held, d.mono.active = nil, false
+}
@@ -0,0 +1,225 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
+	"keyboard3000/pkg/sink"
+	"strings"
+)
+
+const (
+	MpeLowerZone = "lower"
+	MpeUpperZone = "upper"
+)
+
+// channelPool hands out channels for per-note pitch expression, every new note gets its own channel if possible
+type channelPool struct {
+	channels []uint8
+
+	active   map[uint8]int    // map[channel]active notes
+	lastUsed map[uint8]uint64 // map[channel]allocation/release order, least recently used free channel is preferred
+	counter  uint64
+}
+
+// mpe allocates member channels of MPE zone
+type mpe struct {
+	*channelPool
+
+	zone           string
+	manager        uint8
+	members        []uint8
+	pitchBendRange uint8
+
+	latest playedNote // most recent note, target of expression sources
+}
+
+func newChannelPool(channels []uint8) *channelPool {
+	return &channelPool{
+		channels: channels,
+		active:   make(map[uint8]int),
+		lastUsed: make(map[uint8]uint64),
+	}
+}
+
+func newMpe(config MpeConfig) (*mpe, error) {
+	if config.Members < 1 || config.Members > 15 {
+		return nil, fmt.Errorf("mpe members should be in 1-15 range")
+	}
+	if config.PitchBendRange > 96 {
+		return nil, fmt.Errorf("mpe pitch bend range should be in 0-96 range")
+	}
+
+	m := &mpe{
+		zone:           config.Zone,
+		pitchBendRange: config.PitchBendRange,
+	}
+
+	switch config.Zone {
+	case MpeLowerZone, "":
+		m.zone = MpeLowerZone
+		m.manager = 0
+		for channel := uint8(1); channel <= config.Members; channel++ {
+			m.members = append(m.members, channel)
+		}
+	case MpeUpperZone:
+		m.manager = 15
+		for channel := 14; channel >= 15-int(config.Members); channel-- {
+			m.members = append(m.members, uint8(channel))
+		}
+	default:
+		return nil, fmt.Errorf("unknown mpe zone \"%s\"", config.Zone)
+	}
+
+	if m.pitchBendRange == 0 {
+		m.pitchBendRange = 48
+	}
+	m.channelPool = newChannelPool(m.members)
+
+	return m, nil
+}
+
+// returns free channel, least recently used busy channel is shared if every channel is busy
+func (p *channelPool) allocate() uint8 {
+	best := -1
+	for i, channel := range p.channels {
+		if p.active[channel] > 0 {
+			continue
+		}
+		if best < 0 || p.lastUsed[channel] < p.lastUsed[p.channels[best]] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		for i, channel := range p.channels {
+			if best < 0 || p.lastUsed[channel] < p.lastUsed[p.channels[best]] {
+				best = i
+			}
+		}
+	}
+
+	channel := p.channels[best]
+	p.active[channel] += 1
+	p.touch(channel)
+	return channel
+}
+
+func (p *channelPool) release(channel uint8) {
+	if p.active[channel] > 0 {
+		p.active[channel] -= 1
+		p.touch(channel)
+	}
+}
+
+func (p *channelPool) touch(channel uint8) {
+	p.counter += 1
+	p.lastUsed[channel] = p.counter
+}
+
+func (p *channelPool) String() string {
+	var busy []string
+	for _, channel := range p.channels {
+		if p.active[channel] > 0 {
+			busy = append(busy, fmt.Sprintf("%d", channel))
+		}
+	}
+	return fmt.Sprintf("%d/%d busy [%s]", len(busy), len(p.channels), strings.Join(busy, " "))
+}
+
+// MPE configuration message (MCM) and member channels pitch bend range
+func (m *mpe) setupMessages() ([]midi.Message, error) {
+	var messages []midi.Message
+	var err error
+
+	control := func(channel, controller, value uint8) {
+		message, e := midi.NewControlChange(channel, controller, value)
+		if e != nil && err == nil {
+			err = e
+		}
+		messages = append(messages, message)
+	}
+
+	control(m.manager, midi.RpnMSB, 0x00)
+	control(m.manager, midi.RpnLSB, 0x06)
+	control(m.manager, midi.DataEntryMSB, uint8(len(m.members)))
+
+	for _, channel := range m.members {
+		control(channel, midi.RpnMSB, 0x00)
+		control(channel, midi.RpnLSB, 0x00)
+		control(channel, midi.DataEntryMSB, m.pitchBendRange)
+		control(channel, midi.DataEntryLSB, 0x00)
+	}
+
+	for _, channel := range append([]uint8{m.manager}, m.members...) { // rpn null, protects from accidental data entry
+		control(channel, midi.RpnMSB, 0x7f)
+		control(channel, midi.RpnLSB, 0x7f)
+	}
+
+	return messages, err
+}
+
+func (m *mpe) String() string {
+	return fmt.Sprintf("mpe %s: %s", m.zone, m.channelPool)
+}
+
+// returns every output port of device, main one first
+func (d *MidiDevice) ports() []sink.Port {
+	ports := []sink.Port{d.MidiPort}
+	for _, output := range d.Outputs() {
+		ports = append(ports, d.OutputPorts[output])
+	}
+	return ports
+}
+
+// returns pool of per-note channels, nil if notes are played on zone channels
+func (d *MidiDevice) channelPool() *channelPool {
+	if d.mpe != nil {
+		return d.mpe.channelPool
+	}
+	if d.tunings != nil && d.tunings.pool != nil {
+		return d.tunings.pool
+	}
+	return nil
+}
+
+// sends MPE configuration to every device port
+func (d *MidiDevice) setupMpe() {
+	messages, err := d.mpe.setupMessages()
+	if err != nil {
+		logging.Infof("MPE configuration not sent: %s", err)
+		return
+	}
+
+	for _, port := range d.ports() {
+		for _, message := range messages {
+			d.send(port, message, nil)
+		}
+	}
+}
+
+// sends 14bit pitch bend to the most recent note channel in MPE mode, to default zone channel otherwise
+func (d *MidiDevice) sendPitchBend(value uint16) {
+	port, channel := d.expressionTarget()
+	d.pitchBendTo(port, channel, value)
+}
+
+func (d *MidiDevice) pitchBendTo(port sink.Port, channel uint8, value uint16) {
+	message, err := midi.NewPitchBend(channel, value)
+	d.send(port, message, err)
+}
+
+// sends channel pressure, per-note in MPE mode
+func (d *MidiDevice) sendPressure(value uint8) {
+	port, channel := d.expressionTarget()
+
+	message, err := midi.NewChannelPressure(channel, value&0x7f)
+	d.send(port, message, err)
+}
+
+func (d *MidiDevice) expressionTarget() (sink.Port, uint8) {
+	if d.mpe != nil && d.mpe.latest.port != nil {
+		return d.mpe.latest.port, d.mpe.latest.channel
+	}
+	return d.port(d.defaultZone), d.defaultZone.channel
+}
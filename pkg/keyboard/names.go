@@ -0,0 +1,249 @@
+package keyboard
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"keyboard3000/pkg/midi"
+	"strconv"
+	"strings"
+)
+
+const GeneralMidi = "gm"
+
+// ProgramNames keeps human readable bank and program names for a synth
+type ProgramNames struct {
+	banks    map[uint16]string           // map[bank]name
+	programs map[uint16]map[uint8]string // map[bank]map[program]name
+	fallback map[uint8]string            // used for banks without dedicated names (e.g. General MIDI set)
+}
+
+func newProgramNames() ProgramNames {
+	return ProgramNames{
+		banks:    make(map[uint16]string),
+		programs: make(map[uint16]map[uint8]string),
+		fallback: make(map[uint8]string),
+	}
+}
+
+// LoadProgramNames loads names from built-in General MIDI list ("gm") or from MIDNAM xml file
+func LoadProgramNames(source string) (ProgramNames, error) {
+	if source == GeneralMidi {
+		names := newProgramNames()
+		for program, name := range generalMidiPrograms {
+			names.fallback[uint8(program)] = name
+		}
+		return names, nil
+	}
+
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return ProgramNames{}, err
+	}
+	return parseMidnam(data)
+}
+
+func (n ProgramNames) BankName(bank uint16) string {
+	return n.banks[bank]
+}
+
+func (n ProgramNames) ProgramName(bank uint16, program uint8) string {
+	if programs, ok := n.programs[bank]; ok {
+		if name, ok := programs[program]; ok {
+			return name
+		}
+	}
+	return n.fallback[program]
+}
+
+// MIDNAM (MIDI Name Document) structure, only parts needed for bank and patch names
+type midnamDocument struct {
+	Devices []midnamDevice `xml:"MasterDeviceNames"`
+}
+
+type midnamDevice struct {
+	ChannelNameSets []midnamChannelNameSet `xml:"ChannelNameSet"`
+	PatchNameLists  []midnamPatchNameList  `xml:"PatchNameList"`
+}
+
+type midnamChannelNameSet struct {
+	PatchBanks []midnamPatchBank `xml:"PatchBank"`
+}
+
+type midnamPatchBank struct {
+	Name              string               `xml:"Name,attr"`
+	ControlChanges    []midnamControl      `xml:"MIDICommands>ControlChange"`
+	UsesPatchNameList *midnamPatchListRef  `xml:"UsesPatchNameList"`
+	PatchNameList     *midnamPatchNameList `xml:"PatchNameList"`
+}
+
+type midnamControl struct {
+	Control string `xml:"Control,attr"`
+	Value   string `xml:"Value,attr"`
+}
+
+type midnamPatchListRef struct {
+	Name string `xml:"Name,attr"`
+}
+
+type midnamPatchNameList struct {
+	Name    string        `xml:"Name,attr"`
+	Patches []midnamPatch `xml:"Patch"`
+}
+
+type midnamPatch struct {
+	Number        string `xml:"Number,attr"`
+	Name          string `xml:"Name,attr"`
+	ProgramChange string `xml:"ProgramChange,attr"`
+}
+
+func parseMidnam(data []byte) (ProgramNames, error) {
+	var document midnamDocument
+
+	err := xml.Unmarshal(data, &document)
+	if err != nil {
+		return ProgramNames{}, err
+	}
+
+	names := newProgramNames()
+
+	for _, device := range document.Devices {
+		sharedLists := make(map[string]midnamPatchNameList)
+		for _, list := range device.PatchNameLists {
+			sharedLists[list.Name] = list
+		}
+
+		for _, channelSet := range device.ChannelNameSets {
+			for _, patchBank := range channelSet.PatchBanks {
+				bank, err := patchBank.bankNumber()
+				if err != nil {
+					return ProgramNames{}, err
+				}
+
+				var list midnamPatchNameList
+				if patchBank.PatchNameList != nil {
+					list = *patchBank.PatchNameList
+				} else if patchBank.UsesPatchNameList != nil {
+					shared, ok := sharedLists[patchBank.UsesPatchNameList.Name]
+					if !ok {
+						return ProgramNames{}, fmt.Errorf("patch name list \"%s\" not found", patchBank.UsesPatchNameList.Name)
+					}
+					list = shared
+				}
+
+				if _, ok := names.banks[bank]; !ok {
+					names.banks[bank] = patchBank.Name
+				}
+				if _, ok := names.programs[bank]; !ok {
+					names.programs[bank] = make(map[uint8]string)
+				}
+
+				for i, patch := range list.Patches {
+					program, err := patch.programNumber(i)
+					if err != nil {
+						return ProgramNames{}, err
+					}
+					names.programs[bank][program] = patch.Name
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// builds 14bit bank number from bank select MSB (CC0) and LSB (CC32) commands
+func (b midnamPatchBank) bankNumber() (uint16, error) {
+	var msb, lsb uint16
+
+	for _, cc := range b.ControlChanges {
+		control, err := strconv.ParseUint(strings.TrimSpace(cc.Control), 10, 7)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bank select control in \"%s\" bank: %s", b.Name, err)
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(cc.Value), 10, 7)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bank select value in \"%s\" bank: %s", b.Name, err)
+		}
+
+		switch uint8(control) {
+		case midi.BankSelectMSB:
+			msb = uint16(value)
+		case midi.BankSelectLSB:
+			lsb = uint16(value)
+		}
+	}
+
+	return msb<<7 | lsb, nil
+}
+
+// ProgramChange attribute is 0-based, Number attribute is usually 1-based (used as a fallback)
+func (p midnamPatch) programNumber(index int) (uint8, error) {
+	if p.ProgramChange != "" {
+		program, err := strconv.ParseUint(strings.TrimSpace(p.ProgramChange), 10, 7)
+		if err != nil {
+			return 0, fmt.Errorf("invalid program change of \"%s\" patch: %s", p.Name, err)
+		}
+		return uint8(program), nil
+	}
+
+	if number, err := strconv.ParseUint(strings.TrimSpace(p.Number), 10, 8); err == nil && number >= 1 && number <= 128 {
+		return uint8(number - 1), nil
+	}
+
+	if index > 127 {
+		return 0, fmt.Errorf("too many patches, \"%s\" patch is out of program range", p.Name)
+	}
+	return uint8(index), nil
+}
+
+var generalMidiPrograms = [128]string{
+	// piano
+	"Acoustic Grand Piano", "Bright Acoustic Piano", "Electric Grand Piano", "Honky-tonk Piano",
+	"Electric Piano 1", "Electric Piano 2", "Harpsichord", "Clavinet",
+	// chromatic percussion
+	"Celesta", "Glockenspiel", "Music Box", "Vibraphone",
+	"Marimba", "Xylophone", "Tubular Bells", "Dulcimer",
+	// organ
+	"Drawbar Organ", "Percussive Organ", "Rock Organ", "Church Organ",
+	"Reed Organ", "Accordion", "Harmonica", "Tango Accordion",
+	// guitar
+	"Acoustic Guitar (nylon)", "Acoustic Guitar (steel)", "Electric Guitar (jazz)", "Electric Guitar (clean)",
+	"Electric Guitar (muted)", "Overdriven Guitar", "Distortion Guitar", "Guitar Harmonics",
+	// bass
+	"Acoustic Bass", "Electric Bass (finger)", "Electric Bass (pick)", "Fretless Bass",
+	"Slap Bass 1", "Slap Bass 2", "Synth Bass 1", "Synth Bass 2",
+	// strings
+	"Violin", "Viola", "Cello", "Contrabass",
+	"Tremolo Strings", "Pizzicato Strings", "Orchestral Harp", "Timpani",
+	// ensemble
+	"String Ensemble 1", "String Ensemble 2", "Synth Strings 1", "Synth Strings 2",
+	"Choir Aahs", "Voice Oohs", "Synth Voice", "Orchestra Hit",
+	// brass
+	"Trumpet", "Trombone", "Tuba", "Muted Trumpet",
+	"French Horn", "Brass Section", "Synth Brass 1", "Synth Brass 2",
+	// reed
+	"Soprano Sax", "Alto Sax", "Tenor Sax", "Baritone Sax",
+	"Oboe", "English Horn", "Bassoon", "Clarinet",
+	// pipe
+	"Piccolo", "Flute", "Recorder", "Pan Flute",
+	"Blown Bottle", "Shakuhachi", "Whistle", "Ocarina",
+	// synth lead
+	"Lead 1 (square)", "Lead 2 (sawtooth)", "Lead 3 (calliope)", "Lead 4 (chiff)",
+	"Lead 5 (charang)", "Lead 6 (voice)", "Lead 7 (fifths)", "Lead 8 (bass + lead)",
+	// synth pad
+	"Pad 1 (new age)", "Pad 2 (warm)", "Pad 3 (polysynth)", "Pad 4 (choir)",
+	"Pad 5 (bowed)", "Pad 6 (metallic)", "Pad 7 (halo)", "Pad 8 (sweep)",
+	// synth effects
+	"FX 1 (rain)", "FX 2 (soundtrack)", "FX 3 (crystal)", "FX 4 (atmosphere)",
+	"FX 5 (brightness)", "FX 6 (goblins)", "FX 7 (echoes)", "FX 8 (sci-fi)",
+	// ethnic
+	"Sitar", "Banjo", "Shamisen", "Koto",
+	"Kalimba", "Bag pipe", "Fiddle", "Shanai",
+	// percussive
+	"Tinkle Bell", "Agogo", "Steel Drums", "Woodblock",
+	"Taiko Drum", "Melodic Tom", "Synth Drum", "Reverse Cymbal",
+	// sound effects
+	"Guitar Fret Noise", "Breath Noise", "Seashore", "Bird Tweet",
+	"Telephone Ring", "Helicopter", "Applause", "Gunshot",
+}
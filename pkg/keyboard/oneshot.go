@@ -0,0 +1,172 @@
+package keyboard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTempo = 120.0
+
+// oneShot is a key sending note_on and automatic note_off after fixed duration, independent of key release
+type oneShot struct {
+	note     uint8
+	duration time.Duration // fixed duration, used if division is not set
+	beats    float64       // duration in quarter notes, depends on tempo
+}
+
+// gate is a sounding one-shot note waiting for its note_off
+type gate struct {
+	code   uint8 // one-shot key which played the note
+	played playedNote
+	timer  *time.Timer
+}
+
+func newOneShot(config OneShotConfig) (oneShot, error) {
+	o := oneShot{note: config.Note, duration: time.Duration(config.Duration) * time.Millisecond}
+
+	if config.Note > 127 {
+		return oneShot{}, fmt.Errorf("one-shot note should be in 0-127 range")
+	}
+
+	if config.Division != "" {
+		beats, err := parseDivision(config.Division)
+		if err != nil {
+			return oneShot{}, err
+		}
+		o.beats = beats
+	} else if o.duration <= 0 {
+		return oneShot{}, fmt.Errorf("one-shot duration_ms or division is required")
+	}
+
+	return o, nil
+}
+
+// parses note division like "1/16", "1/8." (dotted) or "1/8t" (triplet), returns length in quarter notes
+func parseDivision(division string) (float64, error) {
+	value := strings.TrimSpace(division)
+
+	modifier := 1.0
+	switch {
+	case strings.HasSuffix(value, "."):
+		modifier = 1.5
+		value = value[:len(value)-1]
+	case strings.HasSuffix(value, "t"):
+		modifier = 2.0 / 3.0
+		value = value[:len(value)-1]
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid note division \"%s\"", division)
+	}
+
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || numerator <= 0 {
+		return 0, fmt.Errorf("invalid note division \"%s\"", division)
+	}
+	denominator, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || denominator <= 0 {
+		return 0, fmt.Errorf("invalid note division \"%s\"", division)
+	}
+
+	return 4 * numerator / denominator * modifier, nil
+}
+
+// returns gate length, division based durations follow device tempo
+func (o oneShot) length(tempo float64) time.Duration {
+	if o.beats == 0 {
+		return o.duration
+	}
+	return time.Duration(o.beats * 60 / tempo * float64(time.Second))
+}
+
+// plays one-shot notes (layers included) and schedules their note_off events, key release is ignored
+func (d *MidiDevice) triggerOneShot(code uint8) {
+	shot := d.oneShots[code]
+	z := d.zoneFor(code, shot.note)
+
+	d.closeKeyGates(code) // retrigger, notes of previous press are cut
+
+	for _, v := range d.voices(z, shot.note, d.velocity(z)) {
+		var bend uint16
+		if d.tunings != nil {
+			if !d.tunings.mapped(v.played.note) {
+				continue
+			}
+			if d.tunings.method == TuningPitchBend {
+				v.played.note, bend = d.tunings.pitchBend(v.played.note, d.tuningBendRange())
+			}
+		}
+
+		d.makeRoom(z)
+
+		if pool := d.channelPool(); pool != nil {
+			v.played.channel = pool.allocate()
+		}
+
+		d.notesCount += 1
+		v.played.order = d.notesCount
+
+		g := &gate{code: code, played: v.played}
+		g.timer = time.AfterFunc(shot.length(d.tempo()), func() {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			d.closeGate(g)
+		})
+		d.gates = append(d.gates, g)
+
+		if d.tunings != nil && d.tunings.method == TuningPitchBend {
+			d.pitchBendTo(v.played.port, v.played.channel, bend)
+		}
+		d.noteOn(v.played, v.velocity)
+	}
+}
+
+// sends note_off of gated note, does nothing if gate was already closed (e.g. by panic)
+func (d *MidiDevice) closeGate(g *gate) {
+	for i, active := range d.gates {
+		if active == g {
+			g.timer.Stop()
+			d.gates = append(d.gates[:i], d.gates[i+1:]...)
+			d.forget(g.played)
+			d.noteOff(g.played)
+			return
+		}
+	}
+}
+
+// closes every gate of given zone
+func (d *MidiDevice) closeGates(z *zone) {
+	d.closeMatching(func(g *gate) bool { return g.played.zone == z })
+}
+
+func (d *MidiDevice) closeKeyGates(code uint8) {
+	d.closeMatching(func(g *gate) bool { return g.code == code })
+}
+
+func (d *MidiDevice) closeMatching(match func(g *gate) bool) {
+	var gates []*gate
+	for _, g := range d.gates {
+		if match(g) {
+			gates = append(gates, g)
+		}
+	}
+	for _, g := range gates {
+		d.closeGate(g)
+	}
+}
+
+// shared clock tempo (tap tempo or external clock) takes precedence over configured one
+func (d *MidiDevice) tempo() float64 {
+	if d.Clock != nil {
+		if tempo, ok := d.Clock.Tempo(); ok {
+			return tempo
+		}
+	}
+	if d.Config.Options.Tempo > 0 {
+		return d.Config.Options.Tempo
+	}
+	return defaultTempo
+}
@@ -0,0 +1,195 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/midi"
+	"keyboard3000/pkg/sink"
+	"keyboard3000/pkg/smf"
+	"time"
+)
+
+// playback is a Standard MIDI File played through device port, e.g. backing track for jamming
+type playback struct {
+	song     smf.Song
+	scale    float64         // tempo scale, 2.0 plays twice as fast
+	channels map[uint8]uint8 // map[fileChannel]outputChannel
+
+	// state of current run
+	stop     chan struct{} // closed when playback is stopped, nil if not playing
+	zone     *zone         // zone which port plays the file, panic of this zone stops the playback
+	port     sink.Port
+	sounding map[[2]uint8]bool // set of [channel, note], notes to close on stop and at loop end
+	sustain  map[uint8]bool    // channels with sustain pedal pressed by the file
+}
+
+func newPlayback(config PlaybackConfig) (*playback, error) {
+	if config.TempoScale < 0 {
+		return nil, fmt.Errorf("tempo_scale should be positive")
+	}
+	for from, to := range config.Channels {
+		if from > 15 || to > 15 {
+			return nil, fmt.Errorf("channels should be in 0-15 range")
+		}
+	}
+
+	song, err := smf.ReadFile(config.File)
+	if err != nil {
+		return nil, err
+	}
+	if len(song.Events) == 0 {
+		return nil, fmt.Errorf("no events in \"%s\"", config.File)
+	}
+
+	p := &playback{song: song, scale: config.TempoScale, channels: config.Channels}
+	if p.scale == 0 {
+		p.scale = 1
+	}
+	return p, nil
+}
+
+// starts playback from the beginning, it's restarted if already playing
+func (d *MidiDevice) startPlayback(bind keyBind, loop bool) {
+	p := d.playbacks[bind.playback]
+	d.stopPlayback(p)
+
+	p.stop = make(chan struct{})
+	p.zone = d.zoneByName(bind.zone)
+	p.port = d.port(p.zone)
+	p.sounding = make(map[[2]uint8]bool)
+	p.sustain = make(map[uint8]bool)
+
+	go d.play(p, p.stop, loop)
+}
+
+// stops playback and releases its sounding notes
+func (d *MidiDevice) stopPlayback(p *playback) {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.stop = nil
+	d.closePlayback(p)
+}
+
+// stops every playback played by the zone, part of panic
+func (d *MidiDevice) stopPlaybacks(z *zone) {
+	for _, p := range d.playbacks {
+		if p.zone == z {
+			d.stopPlayback(p)
+		}
+	}
+}
+
+// events are waited out in background, they are sent with device lock like any other key driven event
+func (d *MidiDevice) play(p *playback, stop chan struct{}, loop bool) {
+	for {
+		start := time.Now()
+
+		for _, event := range p.song.Events {
+			if !d.waitPlayback(stop, start.Add(p.scaled(event.Time))) {
+				return
+			}
+			d.mutex.Lock()
+			if d.playbackStopped(stop) {
+				d.mutex.Unlock()
+				return
+			}
+			d.sendPlayback(p, event.Message)
+			d.mutex.Unlock()
+		}
+
+		if !d.waitPlayback(stop, start.Add(p.scaled(p.song.Length))) {
+			return
+		}
+
+		d.mutex.Lock()
+		if d.playbackStopped(stop) {
+			d.mutex.Unlock()
+			return
+		}
+		if !loop {
+			d.stopPlayback(p)
+			d.mutex.Unlock()
+			return
+		}
+		d.closePlayback(p) // notes hanging over loop end would never be released otherwise
+		d.mutex.Unlock()
+	}
+}
+
+// returns false if playback was stopped while waiting
+func (d *MidiDevice) waitPlayback(stop chan struct{}, until time.Time) bool {
+	wait := time.Until(until)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (d *MidiDevice) playbackStopped(stop chan struct{}) bool {
+	if d.closed {
+		return true
+	}
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *MidiDevice) sendPlayback(p *playback, message midi.Message) {
+	if channel, ok := message.Channel(); ok {
+		if to, ok := p.channels[channel]; ok {
+			message, _ = message.WithChannel(to) // remapped channels are validated with config
+			channel = to
+		}
+
+		switch message.Status() {
+		case midi.NoteOn:
+			if message[2] > 0 {
+				p.sounding[[2]uint8{channel, message[1]}] = true
+			} else {
+				delete(p.sounding, [2]uint8{channel, message[1]})
+			}
+		case midi.NoteOff:
+			delete(p.sounding, [2]uint8{channel, message[1]})
+		case midi.ControlChange:
+			if message[1] == midi.Sustain {
+				p.sustain[channel] = message[2] >= 64
+			}
+		}
+	}
+
+	d.send(p.port, message, nil)
+}
+
+// sends note_off for every sounding note of the playback and releases its sustain pedal
+func (d *MidiDevice) closePlayback(p *playback) {
+	for key := range p.sounding {
+		message, err := midi.NewNoteOff(key[0], key[1], 0)
+		d.send(p.port, message, err)
+	}
+	for channel, pressed := range p.sustain {
+		if !pressed {
+			continue
+		}
+		message, err := midi.NewControlChange(channel, midi.Sustain, 0)
+		d.send(p.port, message, err)
+	}
+	p.sounding = make(map[[2]uint8]bool)
+	p.sustain = make(map[uint8]bool)
+}
+
+func (p *playback) scaled(at time.Duration) time.Duration {
+	return time.Duration(float64(at) / p.scale)
+}
@@ -0,0 +1,145 @@
+package keyboard
+
+import (
+	"fmt"
+)
+
+const (
+	StealOldest  = "oldest"
+	StealLowest  = "lowest"
+	StealHighest = "highest"
+)
+
+// polyphony limit, zero max means unlimited
+type polyphony struct {
+	max   int
+	steal string
+}
+
+func newPolyphony(config PolyphonyConfig) (polyphony, error) {
+	p := polyphony{max: config.Max, steal: config.Steal}
+
+	if p.max < 0 {
+		return polyphony{}, fmt.Errorf("max polyphony should be positive")
+	}
+
+	switch p.steal {
+	case "":
+		p.steal = StealOldest
+	case StealOldest, StealLowest, StealHighest:
+	default:
+		return polyphony{}, fmt.Errorf("unknown voice stealing policy \"%s\"", config.Steal)
+	}
+
+	return p, nil
+}
+
+// selects note which should be stolen according to stealing policy
+func (p polyphony) victim(notes []playedNote) playedNote {
+	victim := notes[0]
+	for _, played := range notes[1:] {
+		switch p.steal {
+		case StealOldest:
+			if played.order < victim.order {
+				victim = played
+			}
+		case StealLowest:
+			if played.note < victim.note {
+				victim = played
+			}
+		case StealHighest:
+			if played.note > victim.note {
+				victim = played
+			}
+		}
+	}
+	return victim
+}
+
+func (p polyphony) String() string {
+	return fmt.Sprintf("%d %s", p.max, p.steal)
+}
+
+// returns sounding notes (distinct destinations) of given zone, of whole device for nil zone,
+// notes of pressed keys and open one-shot gates are counted
+func (d *MidiDevice) soundingNotes(z *zone) []playedNote {
+	var notes []playedNote
+
+	add := func(played playedNote) {
+		if z != nil && played.zone != z {
+			return
+		}
+		for i, known := range notes {
+			if known.sameDestination(played) {
+				if played.order < known.order {
+					notes[i] = played
+				}
+				return
+			}
+		}
+		notes = append(notes, played)
+	}
+
+	for _, pressed := range d.pressedKeys {
+		for _, played := range pressed {
+			add(played)
+		}
+	}
+	for _, g := range d.gates {
+		add(g.played)
+	}
+
+	return notes
+}
+
+// steals voices until there is a room for a new note in the zone and in the device
+func (d *MidiDevice) makeRoom(z *zone) {
+	for _, limit := range []struct {
+		zone      *zone
+		polyphony polyphony
+	}{
+		{z, z.polyphony},
+		{nil, d.polyphony},
+	} {
+		if limit.polyphony.max == 0 {
+			continue
+		}
+
+		for {
+			notes := d.soundingNotes(limit.zone)
+			if len(notes) < limit.polyphony.max {
+				break
+			}
+			d.steal(limit.polyphony.victim(notes))
+		}
+	}
+}
+
+// sends note_off of stolen note and removes it from pressedKeys and gates, so key release or gate timer won't
+// duplicate note_off. Keys stay in pressedKeys, even without notes, until they are released
+func (d *MidiDevice) steal(victim playedNote) {
+	var gates []*gate
+	for _, g := range d.gates {
+		if g.played.sameDestination(victim) {
+			g.timer.Stop()
+			d.forget(g.played)
+			continue
+		}
+		gates = append(gates, g)
+	}
+	d.gates = gates
+
+	for code, pressed := range d.pressedKeys {
+		var kept []playedNote
+		for _, played := range pressed {
+			if played.sameDestination(victim) {
+				d.forget(played)
+				continue
+			}
+			kept = append(kept, played)
+		}
+		d.pressedKeys[code] = kept
+	}
+
+	d.noteOff(victim)
+}
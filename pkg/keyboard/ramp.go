@@ -0,0 +1,189 @@
+package keyboard
+
+import (
+	"keyboard3000/pkg/hardware"
+	"keyboard3000/pkg/midi"
+	"math"
+	"time"
+)
+
+const (
+	rampInterval = 5 * time.Millisecond // steady rate of ramp events
+
+	pitchBendCenter = 8192.0
+	modulationMax   = 127.0
+)
+
+// ramp glides value towards target with given rate, e.g. key-driven pitch bend
+type ramp struct {
+	current float64
+	target  float64
+	rate    float64 // units per second, zero means jump
+
+	sent int   // last sent value, rest value at the beginning
+	zone *zone // destination of emitted events
+}
+
+// moves current value towards target, returns true if rounded value changed since last send
+func (r *ramp) step(elapsed time.Duration) bool {
+	if r.current != r.target {
+		delta := r.target - r.current
+		if r.rate == 0 || math.Abs(delta) <= r.rate*elapsed.Seconds() {
+			r.current = r.target
+		} else {
+			r.current += math.Copysign(r.rate*elapsed.Seconds(), delta)
+		}
+	}
+
+	value := int(math.Round(r.current))
+	if value == r.sent {
+		return false
+	}
+	r.sent = value
+	return true
+}
+
+// sets new target reached after given time from current value
+func (r *ramp) glide(target float64, duration time.Duration) {
+	r.target = target
+	r.rate = 0
+	if duration > 0 {
+		r.rate = math.Abs(target-r.current) / duration.Seconds()
+	}
+}
+
+// key-driven pitch bend and modulation state
+type ramps struct {
+	bend       ramp
+	modulation ramp
+
+	bendUp   bool
+	bendDown bool
+
+	bendTarget  float64 // bend_up target distance from center, in pitch bend units
+	bendAttack  time.Duration
+	bendRelease time.Duration
+	modTime     time.Duration // full range modulation ramp time
+
+	done chan bool
+}
+
+func newRamps(bend BendConfig, modulation ModulationConfig) *ramps {
+	if bend.Range == 0 {
+		bend.Range = 2
+	}
+	if bend.Amount == 0 {
+		bend.Amount = bend.Range
+	}
+	if modulation.Time == 0 {
+		modulation.Time = 500
+	}
+
+	target := bend.Amount / bend.Range * (pitchBendCenter - 1)
+	if target > pitchBendCenter-1 {
+		target = pitchBendCenter - 1
+	}
+
+	return &ramps{
+		bend:        ramp{current: pitchBendCenter, target: pitchBendCenter, sent: int(pitchBendCenter)},
+		modulation:  ramp{sent: 0},
+		bendTarget:  target,
+		bendAttack:  time.Duration(bend.Attack) * time.Millisecond,
+		bendRelease: time.Duration(bend.Release) * time.Millisecond,
+		modTime:     time.Duration(modulation.Time) * time.Millisecond,
+		done:        make(chan bool),
+	}
+}
+
+// updates bend target according to held bend keys, bend springs back to center when none is held
+func (r *ramps) updateBend() {
+	switch {
+	case r.bendUp && !r.bendDown:
+		r.bend.glide(pitchBendCenter+r.bendTarget, r.bendAttack)
+	case r.bendDown && !r.bendUp:
+		r.bend.glide(pitchBendCenter-r.bendTarget, r.bendAttack)
+	default:
+		r.bend.glide(pitchBendCenter, r.bendRelease)
+	}
+}
+
+// modulation glides with constant speed, full range takes modTime
+func (r *ramps) glideModulation(target float64) {
+	r.modulation.target = target
+	r.modulation.rate = 0
+	if r.modTime > 0 {
+		r.modulation.rate = modulationMax / r.modTime.Seconds()
+	}
+}
+
+func (d *MidiDevice) handleRamp(bind keyBind, event hardware.KeyEvent) {
+	r := d.ramps
+	z := d.zoneByName(bind.zone)
+
+	switch bind.target {
+	case BendUp:
+		r.bendUp = !event.Released
+		r.bend.zone = z
+		r.updateBend()
+	case BendDown:
+		r.bendDown = !event.Released
+		r.bend.zone = z
+		r.updateBend()
+	case ModUp, ModDown:
+		r.modulation.zone = z
+		if event.Released { // modulation stays where it is
+			r.glideModulation(r.modulation.current)
+		} else if bind.target == ModUp {
+			r.glideModulation(modulationMax)
+		} else {
+			r.glideModulation(0)
+		}
+	case ModHold:
+		r.modulation.zone = z
+		if event.Released { // springs back
+			r.glideModulation(0)
+		} else {
+			r.glideModulation(modulationMax)
+		}
+	}
+}
+
+// per-device timer emitting ramp events at steady rate, exits when device is closed
+func (d *MidiDevice) rampLoop() {
+	ticker := time.NewTicker(rampInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-d.ramps.done:
+			return
+		case now := <-ticker.C:
+			d.mutex.Lock()
+			d.rampTick(now.Sub(last))
+			d.mutex.Unlock()
+			last = now
+		}
+	}
+}
+
+func (d *MidiDevice) rampTick(elapsed time.Duration) {
+	r := d.ramps
+
+	if r.bend.step(elapsed) && r.bend.zone != nil {
+		port, channel := d.port(r.bend.zone), r.bend.zone.channel
+		if d.mpe != nil { // zone-wide bend goes to MPE manager channel
+			channel = d.mpe.manager
+		}
+		d.pitchBendTo(port, channel, uint16(r.bend.sent))
+	}
+
+	if r.modulation.step(elapsed) && r.modulation.zone != nil {
+		channel := r.modulation.zone.channel
+		if d.mpe != nil {
+			channel = d.mpe.manager
+		}
+		message, err := midi.NewControlChange(channel, midi.Modulation, uint8(r.modulation.sent))
+		d.send(d.port(r.modulation.zone), message, err)
+	}
+}
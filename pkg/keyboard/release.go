@@ -0,0 +1,71 @@
+package keyboard
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ReleaseNoteOff = "note_off" // 0x80 with release velocity
+	ReleaseNoteOn  = "note_on"  // 0x90 with velocity 0, running status friendly, release velocity is not sent
+)
+
+// release keeps note_off style and release velocity of the device
+type release struct {
+	style    string
+	velocity uint8 // fixed release velocity, the slowest one in hold mode
+
+	hold  bool          // release velocity derived from hold duration
+	short time.Duration // hold duration of the fastest (127) release
+	long  time.Duration // hold duration of the slowest (velocity) release
+}
+
+func newRelease(config ReleaseConfig) (release, error) {
+	r := release{style: config.Style, velocity: config.Velocity}
+
+	switch r.style {
+	case "":
+		r.style = ReleaseNoteOff
+	case ReleaseNoteOff, ReleaseNoteOn:
+	default:
+		return release{}, fmt.Errorf("unknown note_off style \"%s\"", config.Style)
+	}
+
+	if r.velocity > 127 {
+		return release{}, fmt.Errorf("release velocity should be in 0-127 range")
+	}
+
+	if config.Hold != nil {
+		r.hold = true
+		r.short = time.Duration(config.Hold.Short) * time.Millisecond
+		r.long = time.Duration(config.Hold.Long) * time.Millisecond
+		if config.Hold.Short == 0 {
+			r.short = 100 * time.Millisecond
+		}
+		if config.Hold.Long == 0 {
+			r.long = 2 * time.Second
+		}
+		if r.short >= r.long {
+			return release{}, fmt.Errorf("hold short_ms should be lower than long_ms")
+		}
+	}
+
+	return r, nil
+}
+
+// returns release velocity of note held for given time, short presses are released faster
+func (r release) velocityOf(held time.Duration) uint8 {
+	if !r.hold {
+		return r.velocity
+	}
+
+	switch {
+	case held <= r.short:
+		return 127
+	case held >= r.long:
+		return r.velocity
+	}
+
+	position := float64(held-r.short) / float64(r.long-r.short)
+	return uint8(127 - position*float64(127-r.velocity) + 0.5)
+}
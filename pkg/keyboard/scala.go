@@ -0,0 +1,263 @@
+package keyboard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// scale loaded from Scala .scl file, degree 0 (1/1) is implicit, last degree is the period (usually an octave)
+type scale struct {
+	description string
+	cents       []float64 // cents of degrees 1..n
+}
+
+// keyboard mapping loaded from Scala .kbm file
+type keyboardMapping struct {
+	size          int
+	firstNote     int
+	lastNote      int
+	middleNote    int // note where first mapping entry (degree 0) is mapped
+	referenceNote int
+	referenceFreq float64
+	octaveDegree  int
+	mapping       []int // scale degrees, -1 for unmapped keys
+}
+
+// default mapping, linear from middle C, A4 tuned to 440Hz
+func defaultKeyboardMapping(s scale) keyboardMapping {
+	return keyboardMapping{
+		size:          0,
+		firstNote:     0,
+		lastNote:      127,
+		middleNote:    60,
+		referenceNote: 69,
+		referenceFreq: 440.0,
+		octaveDegree:  len(s.cents),
+	}
+}
+
+// returns non-comment lines of scala file, lines starting with "!" are comments
+func scalaLines(data []byte) []string {
+	var lines []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func loadScale(path string) (scale, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return scale{}, err
+	}
+	return parseScale(data)
+}
+
+func parseScale(data []byte) (scale, error) {
+	lines := scalaLines(data)
+	if len(lines) < 2 {
+		return scale{}, fmt.Errorf("scale description and notes count expected")
+	}
+
+	s := scale{description: strings.TrimSpace(lines[0])}
+
+	count, err := strconv.Atoi(firstField(lines[1]))
+	if err != nil || count < 1 {
+		return scale{}, fmt.Errorf("invalid notes count \"%s\"", strings.TrimSpace(lines[1]))
+	}
+
+	pitches := lines[2:]
+	if len(pitches) < count {
+		return scale{}, fmt.Errorf("%d pitches expected, %d found", count, len(pitches))
+	}
+
+	for _, line := range pitches[:count] {
+		cents, err := parsePitch(firstField(line))
+		if err != nil {
+			return scale{}, err
+		}
+		s.cents = append(s.cents, cents)
+	}
+
+	if s.cents[count-1] <= 0 {
+		return scale{}, fmt.Errorf("scale period should be positive")
+	}
+
+	return s, nil
+}
+
+// pitch is given in cents when it contains a period, as a ratio (or integer) otherwise
+func parsePitch(pitch string) (float64, error) {
+	if strings.Contains(pitch, ".") {
+		cents, err := strconv.ParseFloat(pitch, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cents value \"%s\"", pitch)
+		}
+		return cents, nil
+	}
+
+	numerator, denominator := pitch, "1"
+	if i := strings.Index(pitch, "/"); i >= 0 {
+		numerator, denominator = pitch[:i], pitch[i+1:]
+	}
+
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid ratio \"%s\"", pitch)
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ratio \"%s\"", pitch)
+	}
+
+	return 1200 * math.Log2(n/d), nil
+}
+
+func loadKeyboardMapping(path string) (keyboardMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keyboardMapping{}, err
+	}
+	return parseKeyboardMapping(data)
+}
+
+func parseKeyboardMapping(data []byte) (keyboardMapping, error) {
+	var lines []string
+	for _, line := range scalaLines(data) {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 7 {
+		return keyboardMapping{}, fmt.Errorf("7 header values expected, %d found", len(lines))
+	}
+
+	var header [7]float64
+	for i := range header {
+		value, err := strconv.ParseFloat(firstField(lines[i]), 64)
+		if err != nil {
+			return keyboardMapping{}, fmt.Errorf("invalid header value \"%s\"", strings.TrimSpace(lines[i]))
+		}
+		header[i] = value
+	}
+
+	m := keyboardMapping{
+		size:          int(header[0]),
+		firstNote:     int(header[1]),
+		lastNote:      int(header[2]),
+		middleNote:    int(header[3]),
+		referenceNote: int(header[4]),
+		referenceFreq: header[5],
+		octaveDegree:  int(header[6]),
+	}
+
+	if m.size < 0 || m.referenceFreq <= 0 {
+		return keyboardMapping{}, fmt.Errorf("invalid map size or reference frequency")
+	}
+
+	entries := lines[7:]
+	for i := 0; i < m.size; i++ {
+		if i >= len(entries) { // missing trailing entries are unmapped
+			m.mapping = append(m.mapping, -1)
+			continue
+		}
+
+		entry := firstField(entries[i])
+		if entry == "x" {
+			m.mapping = append(m.mapping, -1)
+			continue
+		}
+
+		degree, err := strconv.Atoi(entry)
+		if err != nil || degree < 0 {
+			return keyboardMapping{}, fmt.Errorf("invalid mapping entry \"%s\"", entry)
+		}
+		m.mapping = append(m.mapping, degree)
+	}
+
+	return m, nil
+}
+
+// returns scale degree of given midi note, false for unmapped keys
+func (m keyboardMapping) degree(note int) (int, bool) {
+	if note < m.firstNote || note > m.lastNote {
+		return 0, false
+	}
+
+	offset := note - m.middleNote
+	if m.size == 0 {
+		return offset, true
+	}
+
+	octave, index := floorDiv(offset, m.size)
+	degree := m.mapping[index]
+	if degree < 0 {
+		return 0, false
+	}
+
+	return degree + octave*m.octaveDegree, true
+}
+
+// returns cents of given (possibly negative or exceeding) scale degree, relative to degree 0
+func (s scale) degreeCents(degree int) float64 {
+	period := s.cents[len(s.cents)-1]
+	octave, index := floorDiv(degree, len(s.cents))
+
+	cents := float64(octave) * period
+	if index > 0 {
+		cents += s.cents[index-1]
+	}
+	return cents
+}
+
+// computes pitch of every midi note as fractional midi note number (69.0 is 440Hz), NaN for unmapped keys
+func tuningTable(s scale, m keyboardMapping) ([128]float64, error) {
+	var table [128]float64
+
+	referenceDegree, ok := m.degree(m.referenceNote)
+	if !ok {
+		return table, fmt.Errorf("reference note %d is not mapped", m.referenceNote)
+	}
+	referenceCents := s.degreeCents(referenceDegree)
+	referencePitch := 69 + 12*math.Log2(m.referenceFreq/440.0)
+
+	for note := range table {
+		degree, ok := m.degree(note)
+		if !ok {
+			table[note] = math.NaN()
+			continue
+		}
+		table[note] = referencePitch + (s.degreeCents(degree)-referenceCents)/100
+	}
+
+	return table, nil
+}
+
+func firstField(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// integer division rounding towards negative infinity, returns quotient and non-negative remainder
+func floorDiv(a, b int) (int, int) {
+	quotient, remainder := a/b, a%b
+	if remainder < 0 {
+		quotient -= 1
+		remainder += b
+	}
+	return quotient, remainder
+}
@@ -0,0 +1,469 @@
+package keyboard
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"keyboard3000/pkg/hardware"
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
+	"os"
+	"time"
+)
+
+// default grid keys, 2x8 steps of current page on number and q rows, so 16 steps fit without paging,
+// rows below select lanes and pages
+var (
+	defaultStepKeys = []uint8{2, 3, 4, 5, 6, 7, 8, 9, 16, 17, 18, 19, 20, 21, 22, 23} // 1-8, q-i
+	defaultLaneKeys = []uint8{30, 31, 32, 33, 34, 35, 36, 37}                         // a-k
+	defaultPageKeys = []uint8{44, 45, 46, 47}                                         // z-v
+)
+
+// sequencer repurposes device keys as step grid, every lane plays its own note
+type sequencer struct {
+	active bool // grid mode, step/lane/page keys don't play notes
+
+	length   int     // steps in pattern
+	tempo    float64 // BPM, steps are 16th notes
+	swing    int     // delay of every second step, percent of step length
+	velocity uint8   // velocity of newly set steps
+	gate     int     // gate of newly set steps, percent of step length
+	file     string  // pattern file of save/load controls
+
+	lanes []*seqLane
+	lane  int // edited lane
+	page  int // edited page
+	held  int // held step index, edited by velocity/gate controls, -1 if none
+
+	stepKeys []uint8
+	laneKeys []uint8
+	pageKeys []uint8
+
+	stop     chan struct{}         // closed when sequencer stops, nil if not running
+	position int                   // currently played step
+	sounding map[uint8]*time.Timer // map[note]gateTimer
+}
+
+type seqLane struct {
+	note  uint8
+	steps []seqStep
+}
+
+type seqStep struct {
+	on       bool
+	velocity uint8
+	gate     int // percent of step length
+}
+
+func newSequencer(config SequencerConfig) (*sequencer, error) {
+	s := &sequencer{
+		length:   config.Steps,
+		tempo:    config.Tempo,
+		swing:    config.Swing,
+		velocity: config.Velocity,
+		gate:     config.Gate,
+		file:     config.File,
+		held:     -1,
+		stepKeys: config.StepKeys,
+		laneKeys: config.LaneKeys,
+		pageKeys: config.PageKeys,
+		sounding: make(map[uint8]*time.Timer),
+	}
+	if s.length == 0 {
+		s.length = 16
+	}
+	if s.velocity == 0 {
+		s.velocity = 100
+	}
+	if s.gate == 0 {
+		s.gate = 50
+	}
+	if s.stepKeys == nil {
+		s.stepKeys = defaultStepKeys
+	}
+	if s.laneKeys == nil {
+		s.laneKeys = defaultLaneKeys
+	}
+	if s.pageKeys == nil {
+		s.pageKeys = defaultPageKeys
+	}
+
+	switch {
+	case s.length < 1 || s.length > 64:
+		return nil, fmt.Errorf("steps should be in 1-64 range")
+	case s.swing < 0 || s.swing > 50:
+		return nil, fmt.Errorf("swing should be in 0-50 range")
+	case s.velocity > 127:
+		return nil, fmt.Errorf("velocity should be in 1-127 range")
+	case s.gate < 1 || s.gate > 100:
+		return nil, fmt.Errorf("gate should be in 1-100 range")
+	case len(s.stepKeys) == 0:
+		return nil, fmt.Errorf("step keys are empty")
+	case len(config.Lanes) > len(s.laneKeys):
+		return nil, fmt.Errorf("%d lanes defined, but only %d lane keys", len(config.Lanes), len(s.laneKeys))
+	}
+
+	for _, note := range config.Lanes {
+		if note > 127 {
+			return nil, fmt.Errorf("lane note should be in 0-127 range")
+		}
+		s.lanes = append(s.lanes, &seqLane{note: note, steps: make([]seqStep, s.length)})
+	}
+	if len(s.lanes) == 0 {
+		s.lanes = []*seqLane{{note: 36, steps: make([]seqStep, s.length)}}
+	}
+
+	if s.file != "" {
+		if _, err := os.Stat(s.file); err == nil {
+			if err := s.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sequencer) pages() int {
+	return (s.length + len(s.stepKeys) - 1) / len(s.stepKeys)
+}
+
+// handles grid keys in sequencer mode, returns false for any other key
+func (d *MidiDevice) handleSequencerKey(event hardware.KeyEvent) bool {
+	s := d.sequencer
+	if s == nil || !s.active {
+		return false
+	}
+	if _, ok := d.pressedBinds[event.Code]; ok { // pressed before mode switch, released as usual
+		return false
+	}
+
+	for i, key := range s.stepKeys {
+		if key != event.Code {
+			continue
+		}
+		index := s.page*len(s.stepKeys) + i
+		if index >= s.length {
+			return true
+		}
+		if event.Released {
+			if s.held == index {
+				s.held = -1
+			}
+			return true
+		}
+
+		s.held = index
+		step := &s.lanes[s.lane].steps[index]
+		if step.on {
+			step.on = false
+		} else {
+			*step = seqStep{on: true, velocity: s.velocity, gate: s.gate}
+		}
+		logging.Infof("Sequencer lane %d step %d: %s", s.lane+1, index+1, step)
+		return true
+	}
+
+	if event.Released {
+		return s.isLaneKey(event.Code) || s.isPageKey(event.Code)
+	}
+
+	for i, key := range s.laneKeys {
+		if key == event.Code {
+			if i < len(s.lanes) {
+				s.lane = i
+				logging.Infof("Sequencer lane %d (note %d)", i+1, s.lanes[i].note)
+			}
+			return true
+		}
+	}
+	for i, key := range s.pageKeys {
+		if key == event.Code {
+			if i < s.pages() {
+				s.page = i
+				logging.Infof("Sequencer page %d/%d", i+1, s.pages())
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sequencer) isLaneKey(code uint8) bool {
+	for _, key := range s.laneKeys {
+		if key == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sequencer) isPageKey(code uint8) bool {
+	for _, key := range s.pageKeys {
+		if key == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sequencer controls, grid mode works without running pattern and the other way round
+func (d *MidiDevice) handleSequencerControl(target uint8) {
+	s := d.sequencer
+
+	switch target {
+	case SequencerToggle:
+		s.active = !s.active
+		s.held = -1
+		logging.Infof("Sequencer grid mode: %t", s.active)
+	case SequencerPlay:
+		if s.stop != nil {
+			d.stopSequencer()
+		} else {
+			s.stop = make(chan struct{})
+			s.position = 0
+			go d.runSequencer(s.stop)
+		}
+	case SequencerTempoUp:
+		s.tempo = d.sequencerTempo() + 1
+	case SequencerTempoDown:
+		if tempo := d.sequencerTempo(); tempo > 20 {
+			s.tempo = tempo - 1
+		}
+	case SequencerSwingUp:
+		s.swing = clamp(s.swing+5, 0, 50)
+	case SequencerSwingDown:
+		s.swing = clamp(s.swing-5, 0, 50)
+	case SequencerVelocityUp, SequencerVelocityDown, SequencerGateUp, SequencerGateDown:
+		if s.held < 0 {
+			logging.Info("Sequencer step edit ignored, hold step key while editing")
+			return
+		}
+		step := &s.lanes[s.lane].steps[s.held]
+		if !step.on {
+			return
+		}
+		switch target {
+		case SequencerVelocityUp:
+			step.velocity = uint8(clamp(int(step.velocity)+8, 1, 127))
+		case SequencerVelocityDown:
+			step.velocity = uint8(clamp(int(step.velocity)-8, 1, 127))
+		case SequencerGateUp:
+			step.gate = clamp(step.gate+10, 1, 100)
+		case SequencerGateDown:
+			step.gate = clamp(step.gate-10, 1, 100)
+		}
+		logging.Infof("Sequencer lane %d step %d: %s", s.lane+1, s.held+1, step)
+	case SequencerClear:
+		s.lanes[s.lane].steps = make([]seqStep, s.length)
+		logging.Infof("Sequencer lane %d cleared", s.lane+1)
+	case SequencerSave:
+		if err := s.save(); err != nil {
+			logging.Infof("Failed to save pattern: %s", err)
+		} else {
+			logging.Infof("Pattern saved to \"%s\"", s.file)
+		}
+	case SequencerLoad:
+		d.stopSequencer()
+		if err := s.load(); err != nil {
+			logging.Infof("Failed to load pattern: %s", err)
+		} else {
+			logging.Infof("Pattern loaded from \"%s\"", s.file)
+		}
+	}
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func (d *MidiDevice) sequencerTempo() float64 {
+	if d.sequencer.tempo > 0 {
+		return d.sequencer.tempo
+	}
+	return d.tempo()
+}
+
+// plays pattern steps until stopped, tempo and swing changes apply from the next step
+func (d *MidiDevice) runSequencer(stop chan struct{}) {
+	s := d.sequencer
+	next := time.Now()
+
+	for {
+		d.mutex.Lock()
+		if d.playbackStopped(stop) {
+			d.mutex.Unlock()
+			return
+		}
+		stepLength := time.Duration(float64(time.Minute) / d.sequencerTempo() / 4)
+		delay := time.Duration(0)
+		if s.position%2 == 1 {
+			delay = stepLength * time.Duration(s.swing) / 100
+		}
+		d.mutex.Unlock()
+
+		if !d.waitPlayback(stop, next.Add(delay)) {
+			return
+		}
+
+		d.mutex.Lock()
+		if d.playbackStopped(stop) {
+			d.mutex.Unlock()
+			return
+		}
+		d.playStep(stepLength)
+		s.position = (s.position + 1) % s.length
+		d.mutex.Unlock()
+
+		next = next.Add(stepLength)
+	}
+}
+
+func (d *MidiDevice) playStep(stepLength time.Duration) {
+	s := d.sequencer
+	port, channel := d.port(d.defaultZone), d.defaultZone.channel
+
+	for _, lane := range s.lanes {
+		step := lane.steps[s.position]
+		if !step.on {
+			continue
+		}
+
+		note := lane.note
+		if timer, ok := s.sounding[note]; ok { // previous gate is still open
+			timer.Stop()
+			message, err := midi.NewNoteOff(channel, note, 0)
+			d.send(port, message, err)
+		}
+
+		message, err := midi.NewNoteOn(channel, note, step.velocity)
+		d.send(port, message, err)
+
+		var timer *time.Timer
+		timer = time.AfterFunc(stepLength*time.Duration(step.gate)/100, func() {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			if s.sounding[note] != timer { // retriggered or stopped meanwhile
+				return
+			}
+			delete(s.sounding, note)
+			message, err := midi.NewNoteOff(channel, note, 0)
+			d.send(port, message, err)
+		})
+		s.sounding[note] = timer
+	}
+}
+
+// stops running pattern and closes its gates
+func (d *MidiDevice) stopSequencer() {
+	s := d.sequencer
+	if s == nil || s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.stop = nil
+
+	port, channel := d.port(d.defaultZone), d.defaultZone.channel
+	for note, timer := range s.sounding {
+		timer.Stop()
+		message, err := midi.NewNoteOff(channel, note, 0)
+		d.send(port, message, err)
+	}
+	s.sounding = make(map[uint8]*time.Timer)
+}
+
+func (s *sequencer) save() error {
+	if s.file == "" {
+		return fmt.Errorf("pattern file is not configured")
+	}
+
+	pattern := PatternConfig{Steps: s.length, Tempo: s.tempo, Swing: s.swing}
+	for _, lane := range s.lanes {
+		patternLane := PatternLaneConfig{Note: lane.note}
+		for i, step := range lane.steps {
+			if step.on {
+				patternLane.Steps = append(patternLane.Steps, PatternStepConfig{i + 1, step.velocity, step.gate})
+			}
+		}
+		pattern.Lanes = append(pattern.Lanes, patternLane)
+	}
+
+	data, err := yaml.Marshal(pattern)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.file, data, 0644)
+}
+
+// replaces pattern with saved one, pattern is left untouched if file is invalid
+func (s *sequencer) load() error {
+	if s.file == "" {
+		return fmt.Errorf("pattern file is not configured")
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	var pattern PatternConfig
+	if err := yaml.Unmarshal(data, &pattern); err != nil {
+		return err
+	}
+	if pattern.Steps < 1 || pattern.Steps > 64 {
+		return fmt.Errorf("steps should be in 1-64 range")
+	}
+	if len(pattern.Lanes) == 0 || len(pattern.Lanes) > len(s.laneKeys) {
+		return fmt.Errorf("1-%d lanes expected", len(s.laneKeys))
+	}
+
+	var lanes []*seqLane
+	for _, patternLane := range pattern.Lanes {
+		if patternLane.Note > 127 {
+			return fmt.Errorf("lane note should be in 0-127 range")
+		}
+		lane := &seqLane{note: patternLane.Note, steps: make([]seqStep, pattern.Steps)}
+		for _, step := range patternLane.Steps {
+			if step.Step < 1 || step.Step > pattern.Steps {
+				return fmt.Errorf("step %d out of pattern", step.Step)
+			}
+			lane.steps[step.Step-1] = seqStep{
+				on:       true,
+				velocity: uint8(clamp(int(step.Velocity), 1, 127)),
+				gate:     clamp(step.Gate, 1, 100),
+			}
+		}
+		lanes = append(lanes, lane)
+	}
+
+	s.lanes, s.length = lanes, pattern.Steps
+	s.tempo, s.swing = pattern.Tempo, clamp(pattern.Swing, 0, 50)
+	s.lane, s.page, s.held, s.position = 0, 0, -1, 0
+	return nil
+}
+
+func (s *seqStep) String() string {
+	if !s.on {
+		return "off"
+	}
+	return fmt.Sprintf("velocity %d, gate %d%%", s.velocity, s.gate)
+}
+
+func (d *MidiDevice) sequencerString() string {
+	s := d.sequencer
+
+	state := "stopped"
+	if s.stop != nil {
+		state = fmt.Sprintf("step %2d/%d", s.position+1, s.length)
+	}
+	mode := ""
+	if s.active {
+		mode = fmt.Sprintf(", grid: lane %d (note %d), page %d/%d", s.lane+1, s.lanes[s.lane].note, s.page+1, s.pages())
+	}
+	return fmt.Sprintf("sequencer: %s, %.0f BPM, swing %d%%%s", state, d.sequencerTempo(), s.swing, mode)
+}
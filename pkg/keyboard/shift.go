@@ -0,0 +1,296 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/hardware"
+	"keyboard3000/pkg/logging"
+	"strconv"
+	"strings"
+)
+
+const (
+	ShiftHold   = "hold"
+	ShiftToggle = "toggle"
+)
+
+// names of commonly used keys, any other key is given by its event code
+var keyNames = map[string]uint8{
+	"esc":    1,
+	"tab":    15,
+	"ctrl":   29,
+	"lctrl":  29,
+	"shift":  42,
+	"lshift": 42,
+	"rshift": 54,
+	"alt":    56,
+	"lalt":   56,
+	"space":  57,
+	"caps":   58,
+	"rctrl":  97,
+	"ralt":   100,
+	"home":   102,
+	"up":     103,
+	"pgup":   104,
+	"left":   105,
+	"right":  106,
+	"end":    107,
+	"down":   108,
+	"pgdn":   109,
+	"ins":    110,
+	"del":    111,
+	"meta":   125,
+	"lmeta":  125,
+	"rmeta":  126,
+}
+
+// shift is an alternate notes/control map, active while its key is held (or toggled)
+type shift struct {
+	name   string
+	key    uint8
+	toggle bool
+	keyMap keyMap // keys missing here fall through to the base key map
+	config ShiftConfig
+}
+
+// combo binds control to key pressed while modifier keys are held, e.g. "ctrl+up"
+type combo struct {
+	name      string
+	modifiers []uint8
+	key       uint8
+	bind      keyBind
+	control   string
+}
+
+// binding resolved at key press with its description
+type boundKey struct {
+	bind  keyBind
+	label string
+}
+
+func parseKeyName(name string) (uint8, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if code, ok := keyNames[name]; ok {
+		return code, nil
+	}
+
+	code, err := strconv.ParseUint(name, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown key \"%s\"", name)
+	}
+	return uint8(code), nil
+}
+
+func (d *MidiDevice) newShift(config ShiftConfig) (*shift, error) {
+	key, err := parseKeyName(config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shift{name: config.Name, key: key, keyMap: make(keyMap), config: config}
+	if s.name == "" {
+		s.name = config.Key
+	}
+
+	switch config.Mode {
+	case "", ShiftHold:
+	case ShiftToggle:
+		s.toggle = true
+	default:
+		return nil, fmt.Errorf("unknown shift mode \"%s\"", config.Mode)
+	}
+
+	for k, v := range config.Notes {
+		s.keyMap[k] = keyBind{target: v, bindType: Note}
+	}
+	d.bindControls(s.keyMap, config.Control)
+
+	return s, nil
+}
+
+func (d *MidiDevice) newCombo(name string, control string) (combo, error) {
+	keys := strings.Split(name, "+")
+	if len(keys) < 2 {
+		return combo{}, fmt.Errorf("at least two keys expected")
+	}
+
+	c := combo{name: name, control: control}
+	for i, key := range keys {
+		code, err := parseKeyName(key)
+		if err != nil {
+			return combo{}, err
+		}
+		if i == len(keys)-1 {
+			c.key = code
+		} else {
+			c.modifiers = append(c.modifiers, code)
+		}
+	}
+
+	bind, err := d.parseBinding(control)
+	if err != nil {
+		return combo{}, err
+	}
+	c.bind = bind
+
+	return c, nil
+}
+
+// adds control bindings to key map, invalid ones are logged and ignored
+func (d *MidiDevice) bindControls(keymap keyMap, controls map[uint8]string) {
+	for k, v := range controls {
+		bind, err := d.parseBinding(v)
+		if err != nil {
+			logging.Infof("Control binding of %d key ignored: %s", k, err)
+			continue
+		}
+		keymap[k] = bind
+	}
+}
+
+// parses control binding and checks that its zone and macro exist
+func (d *MidiDevice) parseBinding(control string) (keyBind, error) {
+	bind, err := parseControl(control)
+	if err != nil {
+		return keyBind{}, err
+	}
+	if d.zoneByName(bind.zone) == nil {
+		return keyBind{}, fmt.Errorf("zone \"%s\" not found", bind.zone)
+	}
+	if _, ok := d.macros[bind.macro]; bind.target == MacroRun && !ok {
+		return keyBind{}, fmt.Errorf("macro \"%s\" not found", bind.macro)
+	}
+	if _, ok := d.playbacks[bind.playback]; bind.playback != "" && !ok {
+		return keyBind{}, fmt.Errorf("playback \"%s\" not found", bind.playback)
+	}
+	return bind, nil
+}
+
+// returns bindings of base key map, shift layers and combos
+func (d *MidiDevice) allBinds() []keyBind {
+	var binds []keyBind
+	for _, bind := range d.keyMap {
+		binds = append(binds, bind)
+	}
+	for _, s := range d.shifts {
+		for _, bind := range s.keyMap {
+			binds = append(binds, bind)
+		}
+	}
+	for _, c := range d.combos {
+		binds = append(binds, c.bind)
+	}
+	for _, g := range d.gestures {
+		for _, bind := range []*keyBind{g.tap, g.long, g.double} {
+			if bind != nil {
+				binds = append(binds, *bind)
+			}
+		}
+	}
+	return binds
+}
+
+// switches shift layer if event comes from shift key, returns false for any other key
+func (d *MidiDevice) handleShift(event hardware.KeyEvent) bool {
+	for _, s := range d.shifts {
+		if s.key != event.Code {
+			continue
+		}
+
+		switch {
+		case s.toggle && !event.Released:
+			if d.shift == s {
+				d.shift = nil
+			} else {
+				d.shift = s
+			}
+		case !s.toggle && !event.Released:
+			d.shift = s
+		case !s.toggle && event.Released:
+			if d.shift == s {
+				d.shift = nil
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (d *MidiDevice) shiftName() string {
+	if d.shift == nil {
+		return "base"
+	}
+	return d.shift.name
+}
+
+// returns binding of key event, combos take precedence over active shift layer, which takes precedence over
+// the base key map. Release follows the binding resolved at press, even if shift layer was switched meanwhile
+func (d *MidiDevice) resolve(event hardware.KeyEvent) (boundKey, bool) {
+	code := event.Code
+
+	if event.Released {
+		if bound, ok := d.pressedBinds[code]; ok {
+			delete(d.pressedBinds, code)
+			return bound, true
+		}
+	}
+
+	bound, ok := d.lookup(code)
+	if ok && !event.Released {
+		d.pressedBinds[code] = bound
+	}
+	return bound, ok
+}
+
+func (d *MidiDevice) lookup(code uint8) (boundKey, bool) {
+	var matched *combo
+	for i, c := range d.combos {
+		if c.key == code && d.modifiersHeld(c) && (matched == nil || len(c.modifiers) > len(matched.modifiers)) {
+			matched = &d.combos[i]
+		}
+	}
+	if matched != nil {
+		return boundKey{matched.bind, fmt.Sprintf("%s: %s", matched.name, matched.control)}, true
+	}
+
+	if d.shift != nil {
+		if bind, ok := d.shift.keyMap[code]; ok {
+			label := describeBind(code, bind, d.shift.config.Control)
+			return boundKey{bind, fmt.Sprintf("%s: %s", d.shift.name, label)}, true
+		}
+	}
+
+	bind, ok := d.keyMap[code]
+	if !ok {
+		return boundKey{}, false
+	}
+	return boundKey{bind, describeBind(code, bind, d.Config.Control)}, true
+}
+
+func (d *MidiDevice) modifiersHeld(c combo) bool {
+	for _, modifier := range c.modifiers {
+		if !d.held[modifier] {
+			return false
+		}
+	}
+	return true
+}
+
+func describeBind(code uint8, bind keyBind, controls map[uint8]string) string {
+	switch bind.bindType {
+	case Control:
+		return controls[code]
+	case OneShot:
+		return fmt.Sprintf("one-shot: %d", bind.target)
+	case Gesture:
+		return "gesture"
+	}
+	return fmt.Sprintf("midi: %d", bind.target)
+}
+
+func (s *shift) String() string {
+	mode := ShiftHold
+	if s.toggle {
+		mode = ShiftToggle
+	}
+	return fmt.Sprintf("shift %s (%s)", s.name, mode)
+}
@@ -0,0 +1,64 @@
+package keyboard
+
+import (
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
+	"keyboard3000/pkg/sink"
+)
+
+// transport controls drive shared clock, devices with clock section send resulting messages
+func (d *MidiDevice) handleTransport(target uint8) {
+	if d.Clock == nil {
+		logging.Info("Transport control ignored, clock is not available")
+		return
+	}
+
+	switch target {
+	case TransportStart:
+		d.Clock.Start()
+	case TransportStop:
+		d.Clock.Stop()
+	case TransportContinue:
+		d.Clock.Continue()
+	case TapTempo:
+		if err := d.Clock.Tap(d.now()); err != nil {
+			logging.Infof("Tap tempo ignored: %s", err)
+			return
+		}
+		if tempo, ok := d.Clock.Tempo(); ok {
+			logging.Infof("Tempo: %.1f BPM", tempo)
+		}
+	}
+}
+
+// SendClock sends transport or midi clock message to clock outputs of the device, see ClockConfig
+func (d *MidiDevice) SendClock(message midi.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	config := d.Config.Clock
+	if d.closed || config == nil {
+		return
+	}
+	if message.Status() == midi.TimingClock && !config.Send {
+		return
+	}
+
+	for _, port := range d.clockPorts() {
+		d.send(port, message, nil)
+	}
+}
+
+func (d *MidiDevice) clockPorts() []sink.Port {
+	if len(d.Config.Clock.Outputs) == 0 {
+		return []sink.Port{d.MidiPort}
+	}
+
+	var ports []sink.Port
+	for _, output := range d.Config.Clock.Outputs {
+		if port, ok := d.OutputPorts[output]; ok {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,278 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/logging"
+	"keyboard3000/pkg/midi"
+	"math"
+	"path/filepath"
+)
+
+const (
+	TuningMtsBulk   = "mts_bulk"   // MIDI Tuning Standard bulk dump (non-realtime SysEx)
+	TuningMtsSingle = "mts_single" // MIDI Tuning Standard single note tuning change (realtime SysEx)
+	TuningPitchBend = "pitch_bend" // per-note pitch bend with channel rotation, for synths without MTS
+
+	mtsProgram      uint8 = 0x00 // tuning program number used for MTS messages
+	mtsSingleChunk        = 64   // notes retuned by single realtime message
+	mtsNoChange           = 0x7f // "no change" frequency data (0x7f 0x7f 0x7f)
+	equalTemperName       = "12-TET"
+)
+
+// tuning is a pitch of every midi note, as fractional midi note number (NaN for unmapped keys)
+type tuning struct {
+	name  string
+	table [128]float64
+}
+
+// tunings keeps loaded tunings, first one is always 12-TET (tuning disabled)
+type tunings struct {
+	method         string
+	pitchBendRange uint8
+	pool           *channelPool // pitch bend method only
+
+	list   []tuning
+	active int
+}
+
+func equalTemperament() tuning {
+	t := tuning{name: equalTemperName}
+	for note := range t.table {
+		t.table[note] = float64(note)
+	}
+	return t
+}
+
+func newTunings(config TuningConfig) (*tunings, error) {
+	t := &tunings{
+		method:         config.Method,
+		pitchBendRange: config.PitchBendRange,
+		list:           []tuning{equalTemperament()},
+	}
+
+	switch t.method {
+	case "":
+		t.method = TuningMtsBulk
+	case TuningMtsBulk, TuningMtsSingle:
+	case TuningPitchBend:
+		channels := config.Channels
+		if len(channels) == 0 {
+			for channel := uint8(0); channel < 16; channel++ {
+				channels = append(channels, channel)
+			}
+		}
+		for _, channel := range channels {
+			if channel > 15 {
+				return nil, fmt.Errorf("tuning channels should be in 0-15 range")
+			}
+		}
+		t.pool = newChannelPool(channels)
+	default:
+		return nil, fmt.Errorf("unknown tuning method \"%s\"", config.Method)
+	}
+
+	if t.pitchBendRange == 0 {
+		t.pitchBendRange = 2
+	}
+
+	for _, file := range config.Files {
+		s, err := loadScale(file.Scale)
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\": %s", file.Scale, err)
+		}
+
+		mapping := defaultKeyboardMapping(s)
+		if file.Mapping != "" {
+			mapping, err = loadKeyboardMapping(file.Mapping)
+			if err != nil {
+				return nil, fmt.Errorf("\"%s\": %s", file.Mapping, err)
+			}
+		}
+
+		table, err := tuningTable(s, mapping)
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\": %s", file.Scale, err)
+		}
+
+		name := s.description
+		if name == "" {
+			name = filepath.Base(file.Scale)
+		}
+		t.list = append(t.list, tuning{name, table})
+	}
+
+	if len(t.list) > 1 { // first loaded tuning is active from the beginning
+		t.active = 1
+	}
+
+	return t, nil
+}
+
+func (t *tunings) current() tuning {
+	return t.list[t.active]
+}
+
+// selects tuning, index 0 is 12-TET
+func (t *tunings) set(index int) bool {
+	if index < 0 || index >= len(t.list) {
+		return false
+	}
+	t.active = index
+	return true
+}
+
+func (t *tunings) change(value int) {
+	t.active = ((t.active+value)%len(t.list) + len(t.list)) % len(t.list)
+}
+
+// returns false if note is not mapped by current tuning
+func (t *tunings) mapped(note uint8) bool {
+	return !math.IsNaN(t.current().table[note])
+}
+
+// returns nearest midi note and pitch bend value realizing tuned pitch of given note
+func (t *tunings) pitchBend(note uint8, bendRange uint8) (uint8, uint16) {
+	pitch := t.current().table[note]
+
+	base := math.Round(pitch)
+	if base < 0 {
+		base = 0
+	} else if base > 127 {
+		base = 127
+	}
+
+	bend := math.Round(8192 + (pitch-base)/float64(bendRange)*8192)
+	if bend < 0 {
+		bend = 0
+	} else if bend > 16383 {
+		bend = 16383
+	}
+
+	return uint8(base), uint16(bend)
+}
+
+// encodes pitch as MTS frequency data: semitone and 14bit fraction of semitone
+func mtsFrequency(pitch float64) [3]byte {
+	if math.IsNaN(pitch) || pitch < 0 || pitch >= 128 {
+		return [3]byte{mtsNoChange, mtsNoChange, mtsNoChange}
+	}
+
+	semitone := math.Floor(pitch)
+	fraction := math.Round((pitch - semitone) * 16384)
+	if fraction >= 16384 {
+		semitone += 1
+		fraction = 0
+	}
+	if semitone > 127 || (semitone == 127 && fraction >= 16383) { // 0x7f 0x7f 0x7f is reserved
+		return [3]byte{0x7f, 0x7f, 0x7e}
+	}
+
+	return [3]byte{uint8(semitone), uint8(int(fraction) >> 7), uint8(int(fraction) & 0x7f)}
+}
+
+// MTS bulk tuning dump of current tuning
+func (t *tunings) bulkDump() (midi.Message, error) {
+	current := t.current()
+
+	data := []byte{0x7e, 0x7f, 0x08, 0x01, mtsProgram}
+
+	var name [16]byte
+	for i := range name {
+		name[i] = ' '
+		if i < len(current.name) && current.name[i] >= 0x20 && current.name[i] < 0x7f {
+			name[i] = current.name[i]
+		}
+	}
+	data = append(data, name[:]...)
+
+	for _, pitch := range current.table {
+		frequency := mtsFrequency(pitch)
+		data = append(data, frequency[:]...)
+	}
+
+	var checksum byte
+	for _, b := range data {
+		checksum ^= b
+	}
+
+	return midi.NewSysEx(append(data, checksum&0x7f))
+}
+
+// MTS realtime single note tuning changes of current tuning, split into several messages
+func (t *tunings) singleNoteChanges() ([]midi.Message, error) {
+	current := t.current()
+
+	var messages []midi.Message
+	for start := 0; start < len(current.table); start += mtsSingleChunk {
+		end := start + mtsSingleChunk
+		if end > len(current.table) {
+			end = len(current.table)
+		}
+
+		data := []byte{0x7f, 0x7f, 0x08, 0x02, mtsProgram, uint8(end - start)}
+		for note := start; note < end; note++ {
+			frequency := mtsFrequency(current.table[note])
+			data = append(data, uint8(note))
+			data = append(data, frequency[:]...)
+		}
+
+		message, err := midi.NewSysEx(data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// sends current tuning to every device port, pitch bend method doesn't require any setup
+func (d *MidiDevice) retune() {
+	var messages []midi.Message
+	var err error
+
+	switch d.tunings.method {
+	case TuningMtsBulk:
+		var message midi.Message
+		message, err = d.tunings.bulkDump()
+		messages = []midi.Message{message}
+	case TuningMtsSingle:
+		messages, err = d.tunings.singleNoteChanges()
+	default:
+		return
+	}
+
+	if err != nil {
+		logging.Infof("Tuning \"%s\" not sent: %s", d.tunings.current().name, err)
+		return
+	}
+
+	for _, port := range d.ports() {
+		for _, message := range messages {
+			d.send(port, message, nil)
+		}
+	}
+}
+
+func (d *MidiDevice) ChangeTuning(value int) {
+	d.tunings.change(value)
+	d.retune()
+}
+
+func (d *MidiDevice) SetTuning(index int) {
+	if d.tunings.set(index) {
+		d.retune()
+	}
+}
+
+// pitch bend range used by pitch bend tuning method, MPE range takes precedence
+func (d *MidiDevice) tuningBendRange() uint8 {
+	if d.mpe != nil {
+		return d.mpe.pitchBendRange
+	}
+	return d.tunings.pitchBendRange
+}
+
+func (t *tunings) String() string {
+	return fmt.Sprintf("tuning: %s", t.current().name)
+}
@@ -0,0 +1,209 @@
+package keyboard
+
+import (
+	"fmt"
+	"keyboard3000/pkg/sink"
+	"strconv"
+	"strings"
+)
+
+// zone is a part of keyboard (key set or note range) with its own channel, transposition and output.
+// Keys not covered by any configured zone are handled by device's default zone
+type zone struct {
+	name string
+
+	keys     map[uint8]bool // map[eventCode]
+	lowNote  uint8          // mapped note range, before transposition
+	highNote uint8
+	hasRange bool
+
+	channel   uint8
+	semitones int8
+	velocity  uint8 // 0 - random
+	program   uint8
+	bank      uint16 // 14bit, CC0 and CC32 combined
+
+	output string // name of additional output port, empty for device's main port
+
+	layers   []layer
+	layering bool // layers are played, toggled by control
+
+	polyphony polyphony
+}
+
+func newZone(config ZoneConfig) (*zone, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("zone name is required")
+	}
+	if config.Channel > 15 {
+		return nil, fmt.Errorf("\"%s\" zone channel should be in 0-15 range", config.Name)
+	}
+	if config.Velocity > 127 {
+		return nil, fmt.Errorf("\"%s\" zone velocity should be in 0-127 range", config.Name)
+	}
+
+	z := &zone{
+		name:      config.Name,
+		keys:      make(map[uint8]bool),
+		channel:   config.Channel,
+		semitones: config.Transpose,
+		velocity:  config.Velocity,
+		output:    config.Output,
+	}
+
+	for _, code := range config.Keys {
+		z.keys[code] = true
+	}
+
+	if config.Notes != "" {
+		low, high, err := parseNoteRange(config.Notes)
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\" zone: %s", config.Name, err)
+		}
+		z.lowNote, z.highNote, z.hasRange = low, high, true
+	}
+
+	if len(z.keys) == 0 && !z.hasRange {
+		return nil, fmt.Errorf("\"%s\" zone has neither keys nor notes defined", config.Name)
+	}
+
+	layers, err := newLayers(config.Layers)
+	if err != nil {
+		return nil, fmt.Errorf("\"%s\" zone: %s", config.Name, err)
+	}
+	z.layers = layers
+	z.layering = len(layers) > 0
+
+	if config.Polyphony != nil {
+		z.polyphony, err = newPolyphony(*config.Polyphony)
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\" zone: %s", config.Name, err)
+		}
+	}
+
+	return z, nil
+}
+
+// parses "36-59" like note range, both sides inclusive
+func parseNoteRange(notes string) (uint8, uint8, error) {
+	bounds := strings.Split(notes, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid note range \"%s\", \"low-high\" expected", notes)
+	}
+
+	low, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 7)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid note range \"%s\": %s", notes, err)
+	}
+	high, err := strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 7)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid note range \"%s\": %s", notes, err)
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("invalid note range \"%s\", low note is higher than high one", notes)
+	}
+
+	return uint8(low), uint8(high), nil
+}
+
+// key sets take precedence over note ranges
+func (z *zone) matchesKey(code uint8) bool {
+	return z.keys[code]
+}
+
+func (z *zone) matchesNote(note uint8) bool {
+	return z.hasRange && note >= z.lowNote && note <= z.highNote
+}
+
+// returns transposed note, false if result is out of midi note range
+func (z *zone) transpose(note uint8) (uint8, bool) {
+	transposed := int(note) + int(z.semitones)
+	if transposed < 0 || transposed > 127 {
+		return 0, false
+	}
+	return uint8(transposed), true
+}
+
+// finds zone responsible for given key and its mapped note
+func (d *MidiDevice) zoneFor(code uint8, note uint8) *zone {
+	for _, z := range d.zones {
+		if z.matchesKey(code) {
+			return z
+		}
+	}
+	for _, z := range d.zones {
+		if z.matchesNote(note) {
+			return z
+		}
+	}
+	return d.defaultZone
+}
+
+// finds zone by name, empty name means default zone
+func (d *MidiDevice) zoneByName(name string) *zone {
+	if name == "" {
+		return d.defaultZone
+	}
+	for _, z := range d.zones {
+		if z.name == name {
+			return z
+		}
+	}
+	return nil
+}
+
+// returns output port of given zone
+func (d *MidiDevice) port(z *zone) sink.Port {
+	if z.output != "" {
+		if port, ok := d.OutputPorts[z.output]; ok {
+			return port
+		}
+	}
+	return d.MidiPort
+}
+
+// Outputs returns names of additional output ports required by zones
+func (d *MidiDevice) Outputs() []string {
+	var outputs []string
+
+Outputs:
+	for _, z := range d.zones {
+		if z.output == "" {
+			continue
+		}
+		for _, output := range outputs {
+			if output == z.output {
+				continue Outputs
+			}
+		}
+		outputs = append(outputs, z.output)
+	}
+
+	return outputs
+}
+
+// AutoConnect returns port names to which given zone output should be connected
+func (d *MidiDevice) AutoConnect(output string) []string {
+	var targets []string
+	for _, zoneConfig := range d.Config.Zones {
+		if zoneConfig.Output == output {
+			targets = append(targets, zoneConfig.AutoConnect...)
+		}
+	}
+	return targets
+}
+
+func (z *zone) String() string {
+	name := z.name
+	if name == "" {
+		name = "main"
+	}
+	description := fmt.Sprintf("%s: ch %d, %+d", name, z.channel, z.semitones)
+	if z.layering {
+		description += fmt.Sprintf(", layers: %v", z.layers)
+	}
+	if z.polyphony.max > 0 {
+		description += fmt.Sprintf(", polyphony: %s", z.polyphony)
+	}
+	return description
+}
@@ -0,0 +1,298 @@
+// Package midi provides typed MIDI 1.0 messages with validation, parsing and printing
+package midi
+
+import (
+	"fmt"
+)
+
+// status bytes, channel messages should be mixed with channel (last four bits)
+const (
+	NoteOff         uint8 = 0x80
+	NoteOn          uint8 = 0x90
+	PolyPressure    uint8 = 0xa0
+	ControlChange   uint8 = 0xb0 // control change and channel mode messages
+	ProgramChange   uint8 = 0xc0
+	ChannelPressure uint8 = 0xd0
+	PitchBend       uint8 = 0xe0
+
+	SysExStart           uint8 = 0xf0
+	TimeCodeQuarterFrame uint8 = 0xf1
+	SongPosition         uint8 = 0xf2
+	SongSelect           uint8 = 0xf3
+	TuneRequest          uint8 = 0xf6
+	SysExEnd             uint8 = 0xf7
+
+	TimingClock   uint8 = 0xf8 // realtime messages, single byte
+	Start         uint8 = 0xfa
+	Continue      uint8 = 0xfb
+	Stop          uint8 = 0xfc
+	ActiveSensing uint8 = 0xfe
+	SystemReset   uint8 = 0xff
+)
+
+// controller numbers
+const (
+	BankSelectMSB uint8 = 0x00 // bank select controllers, MSB (CC0) and LSB (CC32)
+	Modulation    uint8 = 0x01
+	DataEntryMSB  uint8 = 0x06
+	Volume        uint8 = 0x07
+	Pan           uint8 = 0x0a
+	Expression    uint8 = 0x0b
+	BankSelectLSB uint8 = 0x20
+	DataEntryLSB  uint8 = 0x26
+	Sustain       uint8 = 0x40
+	NrpnLSB       uint8 = 0x62
+	NrpnMSB       uint8 = 0x63
+	RpnLSB        uint8 = 0x64 // registered parameter number controllers (CC101 and CC100)
+	RpnMSB        uint8 = 0x65
+
+	AllSoundOff         uint8 = 0x78 // channel mode messages
+	ResetAllControllers uint8 = 0x79
+	LocalControl        uint8 = 0x7a
+	AllNotesOff         uint8 = 0x7b
+	OmniOff             uint8 = 0x7c
+	OmniOn              uint8 = 0x7d
+	MonoOn              uint8 = 0x7e
+	PolyOn              uint8 = 0x7f
+)
+
+const (
+	PitchBendCenter uint16 = 0x2000
+	MaxValue14      uint16 = 0x3fff // max value of 14bit numbers, e.g. pitch bend or song position
+)
+
+// Message is a single complete MIDI message, status byte included
+type Message []byte
+
+func checkChannel(channel uint8) error {
+	if channel > 0x0f {
+		return fmt.Errorf("channel %d out of 0-15 range", channel)
+	}
+	return nil
+}
+
+func checkData(name string, values ...uint8) error {
+	for _, value := range values {
+		if value > 0x7f {
+			return fmt.Errorf("%s %d out of 0-127 range", name, value)
+		}
+	}
+	return nil
+}
+
+func channelMessage(status, channel uint8, data ...uint8) (Message, error) {
+	if err := checkChannel(channel); err != nil {
+		return nil, err
+	}
+	if err := checkData("data byte", data...); err != nil {
+		return nil, err
+	}
+	return append(Message{status | channel}, data...), nil
+}
+
+func NewNoteOff(channel, note, velocity uint8) (Message, error) {
+	if err := checkData("note", note); err != nil {
+		return nil, err
+	}
+	return channelMessage(NoteOff, channel, note, velocity)
+}
+
+func NewNoteOn(channel, note, velocity uint8) (Message, error) {
+	if err := checkData("note", note); err != nil {
+		return nil, err
+	}
+	return channelMessage(NoteOn, channel, note, velocity)
+}
+
+func NewPolyPressure(channel, note, pressure uint8) (Message, error) {
+	return channelMessage(PolyPressure, channel, note, pressure)
+}
+
+func NewControlChange(channel, controller, value uint8) (Message, error) {
+	if err := checkData("controller", controller); err != nil {
+		return nil, err
+	}
+	return channelMessage(ControlChange, channel, controller, value)
+}
+
+func NewProgramChange(channel, program uint8) (Message, error) {
+	if err := checkData("program", program); err != nil {
+		return nil, err
+	}
+	return channelMessage(ProgramChange, channel, program)
+}
+
+func NewChannelPressure(channel, pressure uint8) (Message, error) {
+	return channelMessage(ChannelPressure, channel, pressure)
+}
+
+// 14bit pitch bend, 8192 (PitchBendCenter) is no bend
+func NewPitchBend(channel uint8, value uint16) (Message, error) {
+	if value > MaxValue14 {
+		return nil, fmt.Errorf("pitch bend %d out of 0-%d range", value, MaxValue14)
+	}
+	return channelMessage(PitchBend, channel, uint8(value&0x7f), uint8(value>>7))
+}
+
+// channel mode messages
+
+func NewAllSoundOff(channel uint8) (Message, error) {
+	return NewControlChange(channel, AllSoundOff, 0)
+}
+
+func NewResetAllControllers(channel uint8) (Message, error) {
+	return NewControlChange(channel, ResetAllControllers, 0)
+}
+
+func NewLocalControl(channel uint8, on bool) (Message, error) {
+	var value uint8
+	if on {
+		value = 0x7f
+	}
+	return NewControlChange(channel, LocalControl, value)
+}
+
+func NewAllNotesOff(channel uint8) (Message, error) {
+	return NewControlChange(channel, AllNotesOff, 0)
+}
+
+func NewOmniOff(channel uint8) (Message, error) {
+	return NewControlChange(channel, OmniOff, 0)
+}
+
+func NewOmniOn(channel uint8) (Message, error) {
+	return NewControlChange(channel, OmniOn, 0)
+}
+
+// channels - number of mono channels, 0 means as many as receiver has
+func NewMonoOn(channel, channels uint8) (Message, error) {
+	if channels > 16 {
+		return nil, fmt.Errorf("mono channels %d out of 0-16 range", channels)
+	}
+	return NewControlChange(channel, MonoOn, channels)
+}
+
+func NewPolyOn(channel uint8) (Message, error) {
+	return NewControlChange(channel, PolyOn, 0)
+}
+
+// system common messages
+
+// data without SysExStart and SysExEnd framing, e.g. manufacturer id followed by payload
+func NewSysEx(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty SysEx message")
+	}
+	if err := checkData("SysEx data byte", data...); err != nil {
+		return nil, err
+	}
+
+	message := make(Message, 0, len(data)+2)
+	message = append(message, SysExStart)
+	message = append(message, data...)
+	return append(message, SysExEnd), nil
+}
+
+// messageType 0-7 and its 4bit value
+func NewTimeCodeQuarterFrame(messageType, value uint8) (Message, error) {
+	if messageType > 7 || value > 0x0f {
+		return nil, fmt.Errorf("time code quarter frame %d/%d out of range", messageType, value)
+	}
+	return Message{TimeCodeQuarterFrame, messageType<<4 | value}, nil
+}
+
+// position in MIDI beats (sixteenth notes) since song start
+func NewSongPosition(beats uint16) (Message, error) {
+	if beats > MaxValue14 {
+		return nil, fmt.Errorf("song position %d out of 0-%d range", beats, MaxValue14)
+	}
+	return Message{SongPosition, uint8(beats & 0x7f), uint8(beats >> 7)}, nil
+}
+
+func NewSongSelect(song uint8) (Message, error) {
+	if err := checkData("song", song); err != nil {
+		return nil, err
+	}
+	return Message{SongSelect, song}, nil
+}
+
+func NewTuneRequest() Message {
+	return Message{TuneRequest}
+}
+
+// realtime messages
+
+func NewTimingClock() Message {
+	return Message{TimingClock}
+}
+
+func NewStart() Message {
+	return Message{Start}
+}
+
+func NewContinue() Message {
+	return Message{Continue}
+}
+
+func NewStop() Message {
+	return Message{Stop}
+}
+
+func NewActiveSensing() Message {
+	return Message{ActiveSensing}
+}
+
+func NewSystemReset() Message {
+	return Message{SystemReset}
+}
+
+// Status returns status byte without channel bits for channel messages
+func (m Message) Status() uint8 {
+	if len(m) == 0 {
+		return 0
+	}
+	if m[0] < SysExStart {
+		return m[0] & 0xf0
+	}
+	return m[0]
+}
+
+// Channel returns channel of channel messages, false for system messages
+func (m Message) Channel() (uint8, bool) {
+	if len(m) == 0 || m[0] < 0x80 || m[0] >= SysExStart {
+		return 0, false
+	}
+	return m[0] & 0x0f, true
+}
+
+// WithChannel returns copy of channel message moved to given channel, the message itself isn't modified
+func (m Message) WithChannel(channel uint8) (Message, error) {
+	if _, ok := m.Channel(); !ok {
+		return nil, fmt.Errorf("channel of system message can't be changed")
+	}
+	if err := checkChannel(channel); err != nil {
+		return nil, err
+	}
+	return append(Message{m.Status() | channel}, m[1:]...), nil
+}
+
+// IsRealtime returns true for single byte realtime messages, which may be sent at any time
+func (m Message) IsRealtime() bool {
+	return len(m) == 1 && m[0] >= TimingClock
+}
+
+// Validate checks that the message is a single complete and well-formed MIDI message
+func (m Message) Validate() error {
+	if len(m) == 0 {
+		return fmt.Errorf("empty message")
+	}
+
+	length, err := messageLength(m)
+	if err != nil {
+		return err
+	}
+	if length != len(m) {
+		return fmt.Errorf("message 0x%02x should be %d bytes long, %d found", m[0], length, len(m))
+	}
+	return nil
+}
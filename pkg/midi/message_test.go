@@ -0,0 +1,155 @@
+package midi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConstructors(t *testing.T) {
+	cases := []struct {
+		name     string
+		new      func() (Message, error)
+		expected Message // nil if error is expected
+	}{
+		{"note_off", func() (Message, error) { return NewNoteOff(1, 60, 64) }, Message{0x81, 60, 64}},
+		{"note_off channel", func() (Message, error) { return NewNoteOff(16, 60, 64) }, nil},
+		{"note_off note", func() (Message, error) { return NewNoteOff(0, 128, 64) }, nil},
+		{"note_off velocity", func() (Message, error) { return NewNoteOff(0, 60, 128) }, nil},
+		{"note_on", func() (Message, error) { return NewNoteOn(15, 127, 127) }, Message{0x9f, 127, 127}},
+		{"note_on note", func() (Message, error) { return NewNoteOn(0, 200, 100) }, nil},
+		{"poly_pressure", func() (Message, error) { return NewPolyPressure(2, 60, 10) }, Message{0xa2, 60, 10}},
+		{"poly_pressure value", func() (Message, error) { return NewPolyPressure(2, 60, 0x80) }, nil},
+		{"control_change", func() (Message, error) { return NewControlChange(0, Volume, 100) }, Message{0xb0, 7, 100}},
+		{"control_change controller", func() (Message, error) { return NewControlChange(0, 0x80, 100) }, nil},
+		{"program_change", func() (Message, error) { return NewProgramChange(3, 17) }, Message{0xc3, 17}},
+		{"program_change program", func() (Message, error) { return NewProgramChange(3, 128) }, nil},
+		{"channel_pressure", func() (Message, error) { return NewChannelPressure(0, 5) }, Message{0xd0, 5}},
+		{"channel_pressure channel", func() (Message, error) { return NewChannelPressure(20, 5) }, nil},
+		{"pitch_bend center", func() (Message, error) { return NewPitchBend(0, PitchBendCenter) }, Message{0xe0, 0, 0x40}},
+		{"pitch_bend max", func() (Message, error) { return NewPitchBend(1, MaxValue14) }, Message{0xe1, 0x7f, 0x7f}},
+		{"pitch_bend value", func() (Message, error) { return NewPitchBend(0, MaxValue14+1) }, nil},
+		{"all_notes_off", func() (Message, error) { return NewAllNotesOff(9) }, Message{0xb9, 0x7b, 0}},
+		{"local_control on", func() (Message, error) { return NewLocalControl(0, true) }, Message{0xb0, 0x7a, 0x7f}},
+		{"mono_on", func() (Message, error) { return NewMonoOn(0, 16) }, Message{0xb0, 0x7e, 16}},
+		{"mono_on channels", func() (Message, error) { return NewMonoOn(0, 17) }, nil},
+		{"sysex", func() (Message, error) { return NewSysEx([]byte{0x7e, 0x7f, 0x09, 0x01}) }, Message{0xf0, 0x7e, 0x7f, 0x09, 0x01, 0xf7}},
+		{"sysex empty", func() (Message, error) { return NewSysEx(nil) }, nil},
+		{"sysex data", func() (Message, error) { return NewSysEx([]byte{0x7e, 0xf7}) }, nil},
+		{"time_code", func() (Message, error) { return NewTimeCodeQuarterFrame(7, 0x0f) }, Message{0xf1, 0x7f}},
+		{"time_code type", func() (Message, error) { return NewTimeCodeQuarterFrame(8, 0) }, nil},
+		{"time_code value", func() (Message, error) { return NewTimeCodeQuarterFrame(0, 0x10) }, nil},
+		{"song_position", func() (Message, error) { return NewSongPosition(0x81) }, Message{0xf2, 0x01, 0x01}},
+		{"song_position beats", func() (Message, error) { return NewSongPosition(MaxValue14 + 1) }, nil},
+		{"song_select", func() (Message, error) { return NewSongSelect(3) }, Message{0xf3, 3}},
+		{"song_select song", func() (Message, error) { return NewSongSelect(128) }, nil},
+	}
+
+	for _, c := range cases {
+		message, err := c.new()
+		switch {
+		case c.expected == nil && err == nil:
+			t.Errorf("%s: error expected, got %v", c.name, []byte(message))
+		case c.expected != nil && err != nil:
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		case c.expected != nil && !bytes.Equal(message, c.expected):
+			t.Errorf("%s: got % x, expected % x", c.name, []byte(message), []byte(c.expected))
+		case c.expected != nil:
+			if err := message.Validate(); err != nil {
+				t.Errorf("%s: constructed message is invalid: %s", c.name, err)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		message Message
+		valid   bool
+	}{
+		{Message{0x90, 60, 100}, true},
+		{Message{0xc0, 1}, true},
+		{Message{0xf0, 0x01, 0x02, 0xf7}, true},
+		{Message{0xf0, 0xf7}, true},
+		{Message{0xf8}, true},
+		{Message{0xf6}, true},
+		{Message{0xf2, 0, 0}, true},
+		{Message{}, false},
+		{Message{60, 100}, false},                // data byte without status
+		{Message{0x90, 60}, false},               // truncated
+		{Message{0x90, 60, 100, 1}, false},       // too long
+		{Message{0x90, 60, 0x80}, false},         // status byte as data
+		{Message{0xc0, 1, 2}, false},             // too long
+		{Message{0xf0, 0x01, 0x02}, false},       // unterminated SysEx
+		{Message{0xf0, 0x01, 0xf8, 0xf7}, false}, // realtime inside SysEx isn't part of single message
+		{Message{0xf9}, false},                   // undefined
+		{Message{0xfd}, false},                   // undefined
+		{Message{0xf4}, false},                   // undefined
+		{Message{0xf8, 0xf8}, false},
+	}
+
+	for _, c := range cases {
+		err := c.message.Validate()
+		if c.valid && err != nil {
+			t.Errorf("% x: unexpected error: %s", []byte(c.message), err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("% x: error expected", []byte(c.message))
+		}
+	}
+}
+
+func TestChannel(t *testing.T) {
+	cases := []struct {
+		message Message
+		status  uint8
+		channel uint8
+		ok      bool
+	}{
+		{Message{0x93, 60, 100}, NoteOn, 3, true},
+		{Message{0xbf, 7, 100}, ControlChange, 15, true},
+		{Message{0xf0, 1, 0xf7}, SysExStart, 0, false},
+		{Message{0xf8}, TimingClock, 0, false},
+		{Message{}, 0, 0, false},
+	}
+
+	for _, c := range cases {
+		channel, ok := c.message.Channel()
+		if c.message.Status() != c.status || channel != c.channel || ok != c.ok {
+			t.Errorf(
+				"% x: got status 0x%02x, channel %d (%t), expected 0x%02x, %d (%t)",
+				[]byte(c.message), c.message.Status(), channel, ok, c.status, c.channel, c.ok,
+			)
+		}
+	}
+}
+
+func TestWithChannel(t *testing.T) {
+	original := Message{0x93, 60, 100}
+	message, err := original.WithChannel(10)
+	if err != nil || !bytes.Equal(message, Message{0x9a, 60, 100}) {
+		t.Errorf("got % x (%v), expected 9a 3c 64", []byte(message), err)
+	}
+	if !bytes.Equal(original, Message{0x93, 60, 100}) {
+		t.Errorf("original message modified: % x", []byte(original))
+	}
+
+	if _, err := original.WithChannel(16); err == nil {
+		t.Errorf("error expected for channel 16")
+	}
+	if _, err := NewStart().WithChannel(1); err == nil {
+		t.Errorf("error expected for system message")
+	}
+}
+
+func TestIsRealtime(t *testing.T) {
+	for _, message := range []Message{NewTimingClock(), NewStart(), NewContinue(), NewStop(), NewActiveSensing(), NewSystemReset()} {
+		if !message.IsRealtime() {
+			t.Errorf("% x should be realtime", []byte(message))
+		}
+	}
+	for _, message := range []Message{NewTuneRequest(), {0x90, 60, 100}, {0xf0, 0x01, 0xf7}} {
+		if message.IsRealtime() {
+			t.Errorf("% x shouldn't be realtime", []byte(message))
+		}
+	}
+}
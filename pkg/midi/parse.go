@@ -0,0 +1,135 @@
+package midi
+
+import (
+	"fmt"
+)
+
+// Parse splits raw byte stream (e.g. content of .syx file) into messages,
+// every message has to be well-formed, running status is not supported
+func Parse(data []byte) ([]Message, error) {
+	var messages []Message
+
+	for len(data) > 0 {
+		length, err := messageLength(data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, Message(data[:length]))
+		data = data[length:]
+	}
+
+	return messages, nil
+}
+
+// returns length of the message at the beginning of data
+func messageLength(data []byte) (int, error) {
+	status := data[0]
+	if status < 0x80 {
+		return 0, fmt.Errorf("status byte expected, 0x%02x found", status)
+	}
+
+	var length int
+	switch {
+	case status < ProgramChange, status >= PitchBend && status < SysExStart:
+		length = 3
+	case status < PitchBend: // program change, channel pressure
+		length = 2
+	case status == SysExStart:
+		end := 1
+		for end < len(data) && data[end] < 0x80 {
+			end++
+		}
+		if end == len(data) || data[end] != SysExEnd {
+			return 0, fmt.Errorf("unterminated SysEx message")
+		}
+		return end + 1, nil
+	case status == TimeCodeQuarterFrame, status == SongSelect:
+		length = 2
+	case status == SongPosition:
+		length = 3
+	case status == TuneRequest, status >= TimingClock && status != 0xf9 && status != 0xfd:
+		length = 1
+	default:
+		return 0, fmt.Errorf("undefined status byte 0x%02x", status)
+	}
+
+	if len(data) < length {
+		return 0, fmt.Errorf("message 0x%02x is truncated, %d bytes expected", status, length)
+	}
+	for _, b := range data[1:length] {
+		if b >= 0x80 {
+			return 0, fmt.Errorf("message 0x%02x has invalid data byte 0x%02x", status, b)
+		}
+	}
+
+	return length, nil
+}
+
+var statusNames = map[uint8]string{
+	NoteOff:              "note_off",
+	NoteOn:               "note_on",
+	PolyPressure:         "poly_pressure",
+	ControlChange:        "control_change",
+	ProgramChange:        "program_change",
+	ChannelPressure:      "channel_pressure",
+	PitchBend:            "pitch_bend",
+	SysExStart:           "sysex",
+	TimeCodeQuarterFrame: "time_code",
+	SongPosition:         "song_position",
+	SongSelect:           "song_select",
+	TuneRequest:          "tune_request",
+	TimingClock:          "clock",
+	Start:                "start",
+	Continue:             "continue",
+	Stop:                 "stop",
+	ActiveSensing:        "active_sensing",
+	SystemReset:          "reset",
+}
+
+var modeNames = map[uint8]string{
+	AllSoundOff:         "all_sound_off",
+	ResetAllControllers: "reset_all_controllers",
+	LocalControl:        "local_control",
+	AllNotesOff:         "all_notes_off",
+	OmniOff:             "omni_off",
+	OmniOn:              "omni_on",
+	MonoOn:              "mono_on",
+	PolyOn:              "poly_on",
+}
+
+// String returns human readable message, e.g. "note_on ch:0 note:60 vel:100"
+func (m Message) String() string {
+	if err := m.Validate(); err != nil {
+		return fmt.Sprintf("invalid [% x]", []byte(m))
+	}
+
+	name := statusNames[m.Status()]
+	channel, _ := m.Channel()
+
+	switch m.Status() {
+	case NoteOff, NoteOn:
+		return fmt.Sprintf("%s ch:%d note:%d vel:%d", name, channel, m[1], m[2])
+	case PolyPressure:
+		return fmt.Sprintf("%s ch:%d note:%d value:%d", name, channel, m[1], m[2])
+	case ControlChange:
+		if mode, ok := modeNames[m[1]]; ok {
+			return fmt.Sprintf("%s ch:%d value:%d", mode, channel, m[2])
+		}
+		return fmt.Sprintf("%s ch:%d cc:%d value:%d", name, channel, m[1], m[2])
+	case ProgramChange, ChannelPressure:
+		return fmt.Sprintf("%s ch:%d value:%d", name, channel, m[1])
+	case PitchBend:
+		return fmt.Sprintf("%s ch:%d value:%d", name, channel, uint16(m[1])|uint16(m[2])<<7)
+	case SysExStart:
+		if len(m) > 16 {
+			return fmt.Sprintf("%s [% x ...] (%d bytes)", name, []byte(m[:16]), len(m))
+		}
+		return fmt.Sprintf("%s [% x]", name, []byte(m))
+	case SongPosition:
+		return fmt.Sprintf("%s %d", name, uint16(m[1])|uint16(m[2])<<7)
+	case TimeCodeQuarterFrame, SongSelect:
+		return fmt.Sprintf("%s %d", name, m[1])
+	}
+
+	return name
+}
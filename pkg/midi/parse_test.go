@@ -0,0 +1,92 @@
+package midi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected []Message // nil if error is expected
+	}{
+		{"empty", []byte{}, []Message{}},
+		{
+			"channel messages",
+			[]byte{0x90, 60, 100, 0xc1, 5, 0x80, 60, 0},
+			[]Message{{0x90, 60, 100}, {0xc1, 5}, {0x80, 60, 0}},
+		},
+		{
+			"sysex",
+			[]byte{0xf0, 0x7e, 0x7f, 0x09, 0x01, 0xf7, 0xf0, 0x43, 0xf7},
+			[]Message{{0xf0, 0x7e, 0x7f, 0x09, 0x01, 0xf7}, {0xf0, 0x43, 0xf7}},
+		},
+		{
+			"realtime between messages",
+			[]byte{0xf8, 0x90, 60, 100, 0xfa, 0xfc},
+			[]Message{{0xf8}, {0x90, 60, 100}, {0xfa}, {0xfc}},
+		},
+		{
+			"system common",
+			[]byte{0xf1, 0x12, 0xf2, 0x01, 0x02, 0xf3, 0x04, 0xf6},
+			[]Message{{0xf1, 0x12}, {0xf2, 0x01, 0x02}, {0xf3, 0x04}, {0xf6}},
+		},
+		{"running status", []byte{0x90, 60, 100, 62, 100}, nil},
+		{"realtime inside sysex", []byte{0xf0, 0x43, 0xf8, 0x01, 0xf7}, nil},
+		{"unterminated sysex", []byte{0xf0, 0x43, 0x01}, nil},
+		{"sysex end without start", []byte{0xf7}, nil},
+		{"truncated", []byte{0x90, 60, 100, 0xb0, 7}, nil},
+		{"undefined status", []byte{0xf9}, nil},
+		{"leading data byte", []byte{60, 0x90, 60, 100}, nil},
+	}
+
+	for _, c := range cases {
+		messages, err := Parse(c.data)
+		switch {
+		case c.expected == nil && err == nil:
+			t.Errorf("%s: error expected, got %v", c.name, messages)
+		case c.expected != nil && err != nil:
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		case c.expected != nil && len(c.expected) == 0:
+			if len(messages) != 0 {
+				t.Errorf("%s: got %v, expected no messages", c.name, messages)
+			}
+		case c.expected != nil && !reflect.DeepEqual(messages, c.expected):
+			t.Errorf("%s: got %v, expected %v", c.name, messages, c.expected)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	cases := []struct {
+		message  Message
+		expected string
+	}{
+		{Message{0x90, 60, 100}, "note_on ch:0 note:60 vel:100"},
+		{Message{0x8f, 60, 0}, "note_off ch:15 note:60 vel:0"},
+		{Message{0xa1, 60, 20}, "poly_pressure ch:1 note:60 value:20"},
+		{Message{0xb2, 7, 100}, "control_change ch:2 cc:7 value:100"},
+		{Message{0xb0, 0x7b, 0}, "all_notes_off ch:0 value:0"},
+		{Message{0xc3, 17}, "program_change ch:3 value:17"},
+		{Message{0xd0, 5}, "channel_pressure ch:0 value:5"},
+		{Message{0xe0, 0, 0x40}, "pitch_bend ch:0 value:8192"},
+		{Message{0xf0, 0x43, 0xf7}, "sysex [f0 43 f7]"},
+		{
+			Message{0xf0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 0xf7},
+			"sysex [f0 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f ...] (18 bytes)",
+		},
+		{Message{0xf2, 0x01, 0x01}, "song_position 129"},
+		{Message{0xf3, 4}, "song_select 4"},
+		{Message{0xf6}, "tune_request"},
+		{Message{0xf8}, "clock"},
+		{Message{0xfc}, "stop"},
+		{Message{0x90, 60}, "invalid [90 3c]"},
+	}
+
+	for _, c := range cases {
+		if s := c.message.String(); s != c.expected {
+			t.Errorf("% x: got \"%s\", expected \"%s\"", []byte(c.message), s, c.expected)
+		}
+	}
+}
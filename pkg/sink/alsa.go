@@ -0,0 +1,388 @@
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"keyboard3000/pkg/midi"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ALSA sequencer is used directly through /dev/snd/seq (no libasound needed), see <sound/asequencer.h>
+const (
+	seqDevice = "/dev/snd/seq"
+
+	seqEventSize = 28 // fixed part of struct snd_seq_event
+
+	seqEventNoteOn      = 6
+	seqEventNoteOff     = 7
+	seqEventKeyPress    = 8
+	seqEventController  = 10
+	seqEventPgmChange   = 11
+	seqEventChanPress   = 12
+	seqEventPitchBend   = 13
+	seqEventSongPos     = 20
+	seqEventSongSel     = 21
+	seqEventQFrame      = 22
+	seqEventStart       = 30
+	seqEventContinue    = 31
+	seqEventStop        = 32
+	seqEventClock       = 36
+	seqEventTuneRequest = 40
+	seqEventReset       = 41
+	seqEventSensing     = 42
+	seqEventSysEx       = 130
+
+	seqEventLengthVariable = 1 << 2 // event flag, external data follows the event
+
+	seqQueueDirect        = 253 // event is delivered immediately
+	seqAddressSubscribers = 254 // event is delivered to every subscriber of source port
+	seqAddressUnknown     = 253
+
+	seqUserClient = 1
+
+	seqPortCapRead         = 1 << 0
+	seqPortCapSubsRead     = 1 << 5
+	seqPortTypeMidiGeneric = 1 << 1
+	seqPortTypeApplication = 1 << 20
+
+	iocWrite = 1
+	iocRead  = 2
+)
+
+type seqAddr struct {
+	client uint8
+	port   uint8
+}
+
+// struct snd_seq_client_info
+type seqClientInfo struct {
+	client          int32
+	clientType      int32
+	name            [64]byte
+	filter          uint32
+	multicastFilter [8]byte
+	eventFilter     [32]byte
+	numPorts        int32
+	eventLost       int32
+	card            int32
+	pid             int32
+	reserved        [56]byte
+}
+
+// struct snd_seq_port_info
+type seqPortInfo struct {
+	addr         seqAddr
+	name         [64]byte
+	_            [2]byte
+	capability   uint32
+	portType     uint32
+	midiChannels int32
+	midiVoices   int32
+	synthVoices  int32
+	readUse      int32
+	writeUse     int32
+	kernel       uintptr
+	flags        uint32
+	timeQueue    uint8
+	reserved     [59]byte
+}
+
+// struct snd_seq_port_subscribe
+type seqPortSubscribe struct {
+	sender   seqAddr
+	dest     seqAddr
+	voices   uint32
+	flags    uint32
+	queue    uint8
+	pad      [3]byte
+	reserved [64]byte
+}
+
+func ioc(dir uintptr, nr uintptr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | uintptr('S')<<8 | nr
+}
+
+var (
+	seqIoctlClientID        = ioc(iocRead, 0x01, 4)
+	seqIoctlGetClientInfo   = ioc(iocRead|iocWrite, 0x10, unsafe.Sizeof(seqClientInfo{}))
+	seqIoctlSetClientInfo   = ioc(iocWrite, 0x11, unsafe.Sizeof(seqClientInfo{}))
+	seqIoctlCreatePort      = ioc(iocRead|iocWrite, 0x20, unsafe.Sizeof(seqPortInfo{}))
+	seqIoctlDeletePort      = ioc(iocWrite, 0x21, unsafe.Sizeof(seqPortInfo{}))
+	seqIoctlSubscribePort   = ioc(iocWrite, 0x30, unsafe.Sizeof(seqPortSubscribe{}))
+	seqIoctlQueryNextClient = ioc(iocRead|iocWrite, 0x51, unsafe.Sizeof(seqClientInfo{}))
+	seqIoctlQueryNextPort   = ioc(iocRead|iocWrite, 0x52, unsafe.Sizeof(seqPortInfo{}))
+)
+
+// AlsaSink is ALSA sequencer client, every port is a sequencer port others may subscribe to
+type AlsaSink struct {
+	file   *os.File
+	client uint8
+
+	mutex sync.Mutex
+	ports map[*alsaPort]bool
+	sent  uint64
+}
+
+type alsaPort struct {
+	name string
+	addr seqAddr
+}
+
+func (p *alsaPort) Name() string {
+	return p.name
+}
+
+func NewAlsa(name string) (*AlsaSink, error) {
+	file, err := os.OpenFile(seqDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AlsaSink{file: file, ports: make(map[*alsaPort]bool)}
+
+	var client int32
+	if err := s.ioctl(seqIoctlClientID, unsafe.Pointer(&client)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get client id: %s", err)
+	}
+	s.client = uint8(client)
+
+	info := seqClientInfo{client: client}
+	if err := s.ioctl(seqIoctlGetClientInfo, unsafe.Pointer(&info)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get client info: %s", err)
+	}
+	info.clientType = seqUserClient
+	info.name = [64]byte{}
+	copy(info.name[:63], name)
+	if err := s.ioctl(seqIoctlSetClientInfo, unsafe.Pointer(&info)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set client name: %s", err)
+	}
+
+	return s, nil
+}
+
+func (s *AlsaSink) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, s.file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s *AlsaSink) OpenPort(name string) (Port, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	portName := name
+	for i := 0; s.portNameTaken(portName); i++ { // sequencer allows duplicates, but it's confusing
+		portName = fmt.Sprintf("%s_%d", name, i)
+	}
+
+	info := seqPortInfo{
+		addr:         seqAddr{client: s.client},
+		capability:   seqPortCapRead | seqPortCapSubsRead,
+		portType:     seqPortTypeMidiGeneric | seqPortTypeApplication,
+		midiChannels: 16,
+	}
+	copy(info.name[:63], portName)
+
+	if err := s.ioctl(seqIoctlCreatePort, unsafe.Pointer(&info)); err != nil {
+		return nil, fmt.Errorf("failed to create \"%s\" port: %s", portName, err)
+	}
+
+	p := &alsaPort{name: portName, addr: info.addr}
+	s.ports[p] = true
+	return p, nil
+}
+
+func (s *AlsaSink) portNameTaken(name string) bool {
+	for port := range s.ports {
+		if port.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AlsaSink) ClosePort(port Port) {
+	p, ok := port.(*alsaPort)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.ports, p)
+	info := seqPortInfo{addr: p.addr}
+	s.ioctl(seqIoctlDeletePort, unsafe.Pointer(&info))
+}
+
+// subscribes destination to port, target is "client:port", both given by name or number, e.g. "amsynth:0"
+func (s *AlsaSink) Connect(port Port, target string) error {
+	p, ok := port.(*alsaPort)
+	if !ok {
+		return fmt.Errorf("not an ALSA port")
+	}
+
+	dest, err := s.lookupPort(target)
+	if err != nil {
+		return err
+	}
+
+	subscribe := seqPortSubscribe{sender: p.addr, dest: dest}
+	if err := s.ioctl(seqIoctlSubscribePort, unsafe.Pointer(&subscribe)); err != nil {
+		return fmt.Errorf("subscription failed: %s", err)
+	}
+	return nil
+}
+
+func (s *AlsaSink) lookupPort(target string) (seqAddr, error) {
+	i := strings.LastIndex(target, ":")
+	if i < 0 {
+		return seqAddr{}, fmt.Errorf("\"client:port\" expected, \"%s\" found", target)
+	}
+	clientName, portName := target[:i], target[i+1:]
+
+	client := seqClientInfo{client: -1}
+	for s.ioctl(seqIoctlQueryNextClient, unsafe.Pointer(&client)) == nil {
+		if !nameMatches(clientName, client.client, client.name[:]) {
+			continue
+		}
+
+		port := seqPortInfo{addr: seqAddr{client: uint8(client.client), port: 255}} // port is incremented before query
+		for s.ioctl(seqIoctlQueryNextPort, unsafe.Pointer(&port)) == nil {
+			if nameMatches(portName, int32(port.addr.port), port.name[:]) {
+				return port.addr, nil
+			}
+		}
+	}
+
+	return seqAddr{}, fmt.Errorf("port \"%s\" not found", target)
+}
+
+// matches by number or by name, case insensitive
+func nameMatches(wanted string, number int32, name []byte) bool {
+	if n, err := strconv.Atoi(wanted); err == nil {
+		return int32(n) == number
+	}
+	if end := strings.IndexByte(string(name), 0); end >= 0 {
+		name = name[:end]
+	}
+	return strings.EqualFold(wanted, string(name))
+}
+
+// sends message immediately to every subscriber of port, capture time is not used
+func (s *AlsaSink) Send(port Port, message midi.Message, at time.Time) {
+	p, ok := port.(*alsaPort)
+	if !ok {
+		return
+	}
+
+	event, ok := seqEvent(p.addr, message)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.ports[p] { // port closed meanwhile
+		return
+	}
+	if _, err := s.file.Write(event); err == nil {
+		s.sent += 1
+	}
+}
+
+// encodes message as struct snd_seq_event (little endian layout), SysEx data follows the event
+func seqEvent(source seqAddr, message midi.Message) ([]byte, bool) {
+	if message.Validate() != nil {
+		return nil, false
+	}
+
+	event := make([]byte, seqEventSize)
+	event[3] = seqQueueDirect
+	event[12], event[13] = source.client, source.port
+	event[14], event[15] = seqAddressSubscribers, seqAddressUnknown
+
+	data := event[16:]
+	channel, _ := message.Channel()
+
+	note := func(eventType uint8) {
+		event[0] = eventType
+		data[0], data[1], data[2] = channel, message[1], message[2]
+	}
+	control := func(eventType uint8, param uint32, value int32) {
+		event[0] = eventType
+		data[0] = channel
+		binary.LittleEndian.PutUint32(data[4:8], param)
+		binary.LittleEndian.PutUint32(data[8:12], uint32(value))
+	}
+
+	switch message.Status() {
+	case midi.NoteOn:
+		note(seqEventNoteOn)
+	case midi.NoteOff:
+		note(seqEventNoteOff)
+	case midi.PolyPressure:
+		note(seqEventKeyPress)
+	case midi.ControlChange:
+		control(seqEventController, uint32(message[1]), int32(message[2]))
+	case midi.ProgramChange:
+		control(seqEventPgmChange, 0, int32(message[1]))
+	case midi.ChannelPressure:
+		control(seqEventChanPress, 0, int32(message[1]))
+	case midi.PitchBend:
+		control(seqEventPitchBend, 0, int32(uint16(message[1])|uint16(message[2])<<7)-int32(midi.PitchBendCenter))
+	case midi.SongPosition:
+		control(seqEventSongPos, 0, int32(uint16(message[1])|uint16(message[2])<<7))
+	case midi.SongSelect:
+		control(seqEventSongSel, 0, int32(message[1]))
+	case midi.TimeCodeQuarterFrame:
+		control(seqEventQFrame, 0, int32(message[1]))
+	case midi.TuneRequest:
+		event[0] = seqEventTuneRequest
+	case midi.TimingClock:
+		event[0] = seqEventClock
+	case midi.Start:
+		event[0] = seqEventStart
+	case midi.Continue:
+		event[0] = seqEventContinue
+	case midi.Stop:
+		event[0] = seqEventStop
+	case midi.ActiveSensing:
+		event[0] = seqEventSensing
+	case midi.SystemReset:
+		event[0] = seqEventReset
+	case midi.SysExStart:
+		event[0] = seqEventSysEx
+		event[1] = seqEventLengthVariable
+		binary.LittleEndian.PutUint32(data[0:4], uint32(len(message)))
+		return append(event, message...), true
+	default:
+		return nil, false
+	}
+
+	return event, true
+}
+
+func (s *AlsaSink) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("alsa, client: %d, ports: %d, events sent: %d", s.client, len(s.ports), s.sent)
+}
+
+func (s *AlsaSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.file.Close()
+}
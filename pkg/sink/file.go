@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"keyboard3000/pkg/midi"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a single sent midi event, as written by FileSink and kept by MemorySink
+type Record struct {
+	Time    time.Time    `json:"time"`
+	Port    string       `json:"port"`
+	Data    string       `json:"data"`    // hex bytes, e.g. "90 3c 64"
+	Message string       `json:"message"` // human readable, e.g. "note_on ch:0 note:60 vel:100"
+	Raw     midi.Message `json:"-"`
+}
+
+func newRecord(port Port, message midi.Message, at time.Time) Record {
+	return Record{
+		Time:    at,
+		Port:    port.Name(),
+		Data:    fmt.Sprintf("% x", []byte(message)),
+		Message: message.String(),
+		Raw:     message,
+	}
+}
+
+// namedPort is a port of sinks without real output, it has a name only
+type namedPort struct {
+	name string
+}
+
+func (p *namedPort) Name() string {
+	return p.name
+}
+
+// openNamedPort returns port with unique name, suffixed if it's already taken
+func openNamedPort(ports map[*namedPort]bool, name string) *namedPort {
+	taken := func(name string) bool {
+		for port := range ports {
+			if port.name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	portName := name
+	for i := 0; taken(portName); i++ {
+		portName = fmt.Sprintf("%s_%d", name, i)
+	}
+
+	p := &namedPort{portName}
+	ports[p] = true
+	return p
+}
+
+// FileSink writes every sent midi event as JSON line, e.g. for headless logging
+type FileSink struct {
+	mutex   sync.Mutex
+	output  io.WriteCloser
+	path    string
+	encoder *json.Encoder
+	ports   map[*namedPort]bool
+	written uint64
+}
+
+// NewFile opens sink writing to file of given path, "-" means standard output
+func NewFile(path string) (*FileSink, error) {
+	var output io.WriteCloser = os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+
+	return &FileSink{
+		output:  output,
+		path:    path,
+		encoder: json.NewEncoder(output),
+		ports:   make(map[*namedPort]bool),
+	}, nil
+}
+
+func (s *FileSink) OpenPort(name string) (Port, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return openNamedPort(s.ports, name), nil
+}
+
+func (s *FileSink) ClosePort(port Port) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p, ok := port.(*namedPort); ok {
+		delete(s.ports, p)
+	}
+}
+
+// connections are meaningless for file output
+func (s *FileSink) Connect(port Port, target string) error {
+	return nil
+}
+
+func (s *FileSink) Send(port Port, message midi.Message, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.encoder.Encode(newRecord(port, message, at)); err == nil {
+		s.written += 1
+	}
+}
+
+func (s *FileSink) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("file \"%s\", events written: %d", s.path, s.written)
+}
+
+func (s *FileSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.output != os.Stdout {
+		s.output.Close()
+	}
+}
@@ -0,0 +1,429 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/xthexder/go-jack"
+	"keyboard3000/pkg/midi"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JackSink sends midi events in JACK process callback, scheduled by their capture time with constant latency.
+// `process` runs in realtime thread, so it neither locks nor allocates, it reads events from ring of every port
+// and publishes its state through atomics
+type JackSink struct {
+	stats jackStats // first, 64-bit atomics need to be aligned on 32-bit platforms
+
+	client *jack.Client
+
+	mutex   sync.Mutex    // sync between port (un)registering functions, `process` doesn't use it
+	ports   atomic.Value  // []*jackPort, copied on every change
+	cycles  uint32        // finished `process` calls
+	latency time.Duration // from event capture to its output, one period if zero
+
+	bufferSize uint32
+	sampleRate uint32
+
+	clockInput   atomic.Value // *jackMidiInput
+	clockEvents  eventRing    // realtime messages of clock input, passed to handler outside of `process`
+	clockHandler func(message midi.Message, at time.Time)
+	done         chan struct{}
+	workers      sync.WaitGroup // goroutines using client, it's closed after they stop
+}
+
+const transportInterval = time.Millisecond * 5
+
+type jackPort struct {
+	port  *jack.Port
+	queue eventRing // filled by `Send`, in its order, which is kept in the output as well
+	data  jack.MidiData
+}
+
+func (p *jackPort) Name() string {
+	return p.port.GetName()
+}
+
+// frames are JACK frame time, it wraps around every ~24h at 48kHz so differences are used only
+type jackEvent struct {
+	capture uint32
+	target  uint32 // capture + latency
+	data    []byte
+}
+
+// scheduling stats, delay is time from event capture to the frame it was written at
+type jackStats struct {
+	sent     uint64
+	late     uint64 // events which missed their frame and were written at the start of later cycle
+	overflow uint64 // events dropped because ring was full
+	dropped  uint64 // events bigger than whole port buffer, e.g. long SysEx
+	maxLate  uint32
+	jitter   uint32 // delay spread of the last full window, zero with constant latency
+
+	// used by `process` only
+	windowStart uint32
+	minDelay    uint32 // current window
+	maxDelay    uint32
+}
+
+func (st *jackStats) written(delay uint32) {
+	if delay < st.minDelay {
+		st.minDelay = delay
+	}
+	if delay > st.maxDelay {
+		st.maxDelay = delay
+	}
+	atomic.AddUint64(&st.sent, 1)
+}
+
+func (st *jackStats) missed(frames uint32) {
+	atomic.AddUint64(&st.late, 1)
+	if frames > atomic.LoadUint32(&st.maxLate) {
+		atomic.StoreUint32(&st.maxLate, frames)
+	}
+}
+
+// every second delays measured so far make new jitter value
+func (st *jackStats) cycle(frame, sampleRate uint32) {
+	if frame-st.windowStart < sampleRate {
+		return
+	}
+	st.windowStart = frame
+	if st.maxDelay >= st.minDelay { // anything was written
+		atomic.StoreUint32(&st.jitter, st.maxDelay-st.minDelay)
+	}
+	st.minDelay, st.maxDelay = ^uint32(0), 0
+}
+
+func NewJack(name string, latency time.Duration, onShutdown func()) (*JackSink, error) {
+	if latency < 0 {
+		return nil, fmt.Errorf("latency should be positive")
+	}
+
+	client, status := jack.ClientOpen(name, jack.NoStartServer)
+	if status != 0 {
+		return nil, fmt.Errorf("failed to open JACK client, is JACK server running? status: %d", status)
+	}
+
+	s := &JackSink{
+		client:  client,
+		latency: latency,
+		done:    make(chan struct{}),
+	}
+	s.stats.minDelay = ^uint32(0)
+	s.ports.Store([]*jackPort{})
+	s.clockInput.Store((*jackMidiInput)(nil))
+
+	s.bufferSize = client.GetBufferSize()
+	s.sampleRate = client.GetSampleRate()
+	status = client.SetBufferSizeCallback(func(buffer uint32) int { atomic.StoreUint32(&s.bufferSize, buffer); return 0 })
+	if status != 0 {
+		client.Close()
+		return nil, fmt.Errorf("failed to set buffer size callback")
+	}
+
+	client.OnShutdown(onShutdown)
+
+	status = client.SetProcessCallback(s.process)
+	if status != 0 {
+		client.Close()
+		return nil, fmt.Errorf("failed to set process callback")
+	}
+
+	if code := client.Activate(); code != 0 {
+		client.Close()
+		return nil, fmt.Errorf("failed to activate client, code: %d", code)
+	}
+
+	return s, nil
+}
+
+// writes queued events which are due in this cycle, events due later wait for their cycle
+func (s *JackSink) process(nframes uint32) int {
+	s.readClockInput(nframes)
+
+	cycleStart := s.client.GetLastFrameTime()
+	s.stats.cycle(cycleStart, s.sampleRate)
+
+	ports, _ := s.ports.Load().([]*jackPort)
+	for _, port := range ports {
+		buffer := port.port.MidiClearBuffer(nframes) // every port buffer needs to be clear every cycle
+
+		var offset, written uint32
+		for {
+			event, ok := port.queue.peek()
+			if !ok {
+				break
+			}
+
+			due := int32(event.target - cycleStart)
+			if due >= int32(nframes) {
+				break
+			}
+			if due < 0 {
+				s.stats.missed(uint32(-due))
+				due = 0
+			}
+			if uint32(due) > offset { // never before previous event, so order of the port is kept
+				offset = uint32(due)
+			}
+
+			port.data.Time, port.data.Buffer = offset, event.data
+			if port.port.MidiEventWrite(&port.data, buffer) != 0 {
+				if offset == 0 && written == 0 { // doesn't fit even empty buffer, waiting would block the port forever
+					atomic.AddUint64(&s.stats.dropped, 1)
+					port.queue.pop()
+					continue
+				}
+				break // buffer is full, rest stays for next cycle
+			}
+			s.stats.written(cycleStart + offset - event.capture)
+			written += 1
+			port.queue.pop()
+		}
+		port.data.Buffer = nil
+	}
+
+	atomic.AddUint32(&s.cycles, 1)
+	return 0
+}
+
+// queues realtime messages of clock input with their frame time, `passClockEvents` hands them over
+func (s *JackSink) readClockInput(nframes uint32) {
+	input, _ := s.clockInput.Load().(*jackMidiInput)
+	if input == nil {
+		return
+	}
+
+	cycleStart := s.client.GetLastFrameTime()
+	for i, count := 0, input.cycle(nframes); i < count; i++ {
+		offset, message, ok := input.realtime(i)
+		if !ok {
+			continue
+		}
+		if !s.clockEvents.push(jackEvent{capture: cycleStart + offset, data: message}) {
+			atomic.AddUint64(&s.stats.overflow, 1)
+		}
+	}
+}
+
+// passes clock input messages to handler, with time converted back from their frame time
+func (s *JackSink) passClockEvents() {
+	defer s.workers.Done()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			event, ok := s.clockEvents.peek()
+			if !ok {
+				break
+			}
+			now, frame := time.Now(), s.client.GetFrameTime()
+			s.clockHandler(midi.Message(event.data), now.Add(-s.duration(frame-event.capture)))
+			s.clockEvents.pop()
+		}
+	}
+}
+
+// queries transport in caller's thread, JACK allows it from any thread and go-jack allocates the position,
+// so it's kept out of `process`
+func (s *JackSink) Transport() Transport {
+	state, position := s.client.TransportQuery()
+	if position == nil {
+		return Transport{}
+	}
+
+	transport := Transport{
+		Rolling: state == jack.TransportRolling,
+		Frame:   position.Frame,
+		BBT:     position.Valid&jack.PositionBBT != 0,
+	}
+	if transport.BBT {
+		transport.Bar = position.Bar
+		transport.Beat = position.Beat
+		transport.Tick = position.Tick
+		transport.Tempo = position.BeatsPerMinute
+	}
+	return transport
+}
+
+func (s *JackSink) FollowTransport(handler func(transport Transport)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		ticker := time.NewTicker(transportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			handler(s.Transport())
+		}
+	}()
+}
+
+func (s *JackSink) OpenClockInput(name string, handler func(message midi.Message, at time.Time)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if input, _ := s.clockInput.Load().(*jackMidiInput); input != nil {
+		return fmt.Errorf("clock input is already opened")
+	}
+	port := s.client.PortRegister(name, jack.DEFAULT_MIDI_TYPE, jack.PortIsInput, 0)
+	if port == nil {
+		return fmt.Errorf("failed to register \"%s\" port", name)
+	}
+	s.clockHandler = handler
+	s.clockInput.Store(&jackMidiInput{port: port})
+	s.workers.Add(1)
+	go s.passClockEvents()
+	return nil
+}
+
+// queues event to be sent in `process` callback, `at` capture time is converted to JACK frame time.
+// Port queue has single producer, so Send should be called from one goroutine only
+func (s *JackSink) Send(port Port, message midi.Message, at time.Time) {
+	p, ok := port.(*jackPort)
+	if !ok {
+		return
+	}
+
+	capture := s.client.GetFrameTime() - s.frames(time.Since(at))
+	if !p.queue.push(jackEvent{capture, capture + s.latencyFrames(), message}) {
+		atomic.AddUint64(&s.stats.overflow, 1)
+	}
+}
+
+func (s *JackSink) frames(duration time.Duration) uint32 {
+	if duration <= 0 {
+		return 0
+	}
+	return uint32(int64(duration) * int64(s.sampleRate) / int64(time.Second))
+}
+
+func (s *JackSink) duration(frames uint32) time.Duration {
+	if s.sampleRate == 0 {
+		return 0
+	}
+	return time.Duration(int64(frames) * int64(time.Second) / int64(s.sampleRate))
+}
+
+func (s *JackSink) latencyFrames() uint32 {
+	if s.latency == 0 {
+		return atomic.LoadUint32(&s.bufferSize)
+	}
+	return s.frames(s.latency)
+}
+
+func (s *JackSink) milliseconds(frames uint32) float64 {
+	return float64(s.duration(frames)) / float64(time.Millisecond)
+}
+
+// plox JACK server for keyboard socket
+func (s *JackSink) OpenPort(name string) (Port, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	port := s.client.PortRegister(name, jack.DEFAULT_MIDI_TYPE, jack.PortIsOutput, 0)
+
+	// in case of already opened port with requested name adding suffixes is tried
+	for i := 0; port == nil && i < 128; i++ {
+		portName := fmt.Sprintf("%s_%d", name, i)
+		port = s.client.PortRegister(portName, jack.DEFAULT_MIDI_TYPE, jack.PortIsOutput, 0)
+	}
+	if port == nil {
+		return nil, fmt.Errorf("failed to register \"%s\" port", name)
+	}
+
+	p := &jackPort{port: port}
+	ports := s.ports.Load().([]*jackPort)
+	s.ports.Store(append(append([]*jackPort{}, ports...), p))
+	return p, nil
+}
+
+func (s *JackSink) ClosePort(port Port) {
+	p, ok := port.(*jackPort)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ports := []*jackPort{}
+	for _, other := range s.ports.Load().([]*jackPort) {
+		if other != p {
+			ports = append(ports, other)
+		}
+	}
+	s.ports.Store(ports)
+
+	s.waitCycle() // `process` running meanwhile may still write to the port
+	s.client.PortUnregister(p.port)
+}
+
+// waits until `process` runs twice, gives up after a while in case JACK doesn't call it anymore
+func (s *JackSink) waitCycle() {
+	start := atomic.LoadUint32(&s.cycles)
+	for i := 0; i < 100 && atomic.LoadUint32(&s.cycles)-start < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *JackSink) Connect(port Port, target string) error {
+	p, ok := port.(*jackPort)
+	if !ok {
+		return fmt.Errorf("not a JACK port")
+	}
+
+	targetPort := s.client.GetPortByName(target)
+	if targetPort == nil {
+		return fmt.Errorf("port \"%s\" not found", target)
+	}
+
+	if code := s.client.ConnectPorts(p.port, targetPort); code != 0 {
+		return fmt.Errorf("connection failed, code: %d", code)
+	}
+	return nil
+}
+
+func (s *JackSink) Status() string {
+	transport := s.Transport()
+	state := "stopped"
+	if transport.Rolling {
+		state = "rolling"
+	}
+	if transport.BBT {
+		state += fmt.Sprintf(" %d|%d|%04d %.1f BPM", transport.Bar, transport.Beat, transport.Tick, transport.Tempo)
+	}
+
+	queued := 0
+	for _, port := range s.ports.Load().([]*jackPort) {
+		queued += port.queue.len()
+	}
+
+	return fmt.Sprintf(
+		"jack, buffer size: %d, sample_rate: %d, latency: %.1fms, queued events: %d, sent: %d, "+
+			"late: %d (max %.1fms), jitter: %.1fms, overflow: %d, dropped: %d, transport: %s",
+		atomic.LoadUint32(&s.bufferSize), s.sampleRate, s.milliseconds(s.latencyFrames()), queued,
+		atomic.LoadUint64(&s.stats.sent), atomic.LoadUint64(&s.stats.late),
+		s.milliseconds(atomic.LoadUint32(&s.stats.maxLate)), s.milliseconds(atomic.LoadUint32(&s.stats.jitter)),
+		atomic.LoadUint64(&s.stats.overflow), atomic.LoadUint64(&s.stats.dropped), state,
+	)
+}
+
+func (s *JackSink) Close() {
+	close(s.done)
+	s.workers.Wait()
+	s.client.Close()
+}
@@ -0,0 +1,46 @@
+package sink
+
+/*
+#cgo LDFLAGS: -ljack
+#include <jack/midiport.h>
+*/
+import "C"
+
+import (
+	"github.com/xthexder/go-jack"
+	"unsafe"
+)
+
+// single byte realtime messages (0xf8-0xff), input events are sliced from it, so reading them doesn't allocate
+var realtimeMessages = []byte{0xf8, 0xf9, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff}
+
+// jackMidiInput reads midi input port in `process` without go-jack's GetMidiEvents, which allocates every event
+type jackMidiInput struct {
+	port   *jack.Port
+	buffer unsafe.Pointer      // port buffer of current cycle
+	event  C.jack_midi_event_t // reused by every read
+}
+
+// cycle gets port buffer of current cycle and returns number of its events
+func (in *jackMidiInput) cycle(nframes uint32) int {
+	samples := in.port.GetBuffer(nframes) // midi buffer seen as audio one, only its address is used
+	if len(samples) == 0 {
+		in.buffer = nil
+		return 0
+	}
+	in.buffer = unsafe.Pointer(&samples[0])
+	return int(C.jack_midi_get_event_count(in.buffer))
+}
+
+// realtime returns offset in the cycle and message of i-th event, false if it's not realtime message
+func (in *jackMidiInput) realtime(i int) (uint32, []byte, bool) {
+	if C.jack_midi_event_get(&in.event, in.buffer, C.uint32_t(i)) != 0 || in.event.size != 1 {
+		return 0, nil, false
+	}
+	status := *(*byte)(unsafe.Pointer(in.event.buffer))
+	if status < realtimeMessages[0] {
+		return 0, nil, false
+	}
+	index := status - realtimeMessages[0]
+	return uint32(in.event.time), realtimeMessages[index : index+1], true
+}
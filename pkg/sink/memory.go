@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"fmt"
+	"keyboard3000/pkg/midi"
+	"sync"
+	"time"
+)
+
+// MemorySink keeps every sent midi event in memory, e.g. for golden tests without JACK
+type MemorySink struct {
+	mutex       sync.Mutex
+	ports       map[*namedPort]bool
+	records     []Record
+	connections map[string][]string // map[port][]target
+}
+
+func NewMemory() *MemorySink {
+	return &MemorySink{ports: make(map[*namedPort]bool), connections: make(map[string][]string)}
+}
+
+func (s *MemorySink) OpenPort(name string) (Port, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return openNamedPort(s.ports, name), nil
+}
+
+func (s *MemorySink) ClosePort(port Port) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p, ok := port.(*namedPort); ok {
+		delete(s.ports, p)
+	}
+}
+
+// records requested connection, see Connections()
+func (s *MemorySink) Connect(port Port, target string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connections[port.Name()] = append(s.connections[port.Name()], target)
+	return nil
+}
+
+func (s *MemorySink) Send(port Port, message midi.Message, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, newRecord(port, message, at))
+}
+
+// Records returns copy of sent events, in send order
+func (s *MemorySink) Records() []Record {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Record(nil), s.records...)
+}
+
+// Messages returns human readable messages sent to given port, handy for golden comparisons
+func (s *MemorySink) Messages(port Port) []string {
+	var messages []string
+	for _, record := range s.Records() {
+		if record.Port == port.Name() {
+			messages = append(messages, record.Message)
+		}
+	}
+	return messages
+}
+
+func (s *MemorySink) Connections(port Port) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.connections[port.Name()]...)
+}
+
+// Reset forgets sent events
+func (s *MemorySink) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = nil
+}
+
+func (s *MemorySink) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("memory, events kept: %d", len(s.records))
+}
+
+func (s *MemorySink) Close() {}
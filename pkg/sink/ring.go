@@ -0,0 +1,44 @@
+package sink
+
+import "sync/atomic"
+
+const ringSize = 1024 // power of two, so index wraps together with uint32 counters
+
+// eventRing is single producer, single consumer queue, neither side locks or allocates,
+// so JACK process callback never waits for Go code
+type eventRing struct {
+	head   uint32 // next event to read, written by consumer only
+	tail   uint32 // next free slot, written by producer only
+	events [ringSize]jackEvent
+}
+
+// push is called by producer, false if ring is full
+func (r *eventRing) push(event jackEvent) bool {
+	tail := atomic.LoadUint32(&r.tail)
+	if tail-atomic.LoadUint32(&r.head) == ringSize {
+		return false
+	}
+	r.events[tail%ringSize] = event
+	atomic.StoreUint32(&r.tail, tail+1) // publishes the event
+	return true
+}
+
+// peek is called by consumer, returned event stays in ring until pop
+func (r *eventRing) peek() (*jackEvent, bool) {
+	head := atomic.LoadUint32(&r.head)
+	if head == atomic.LoadUint32(&r.tail) {
+		return nil, false
+	}
+	return &r.events[head%ringSize], true
+}
+
+// pop is called by consumer, drops event returned by peek and frees its slot
+func (r *eventRing) pop() {
+	head := atomic.LoadUint32(&r.head)
+	r.events[head%ringSize].data = nil
+	atomic.StoreUint32(&r.head, head+1)
+}
+
+func (r *eventRing) len() int {
+	return int(atomic.LoadUint32(&r.tail) - atomic.LoadUint32(&r.head))
+}
@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"runtime"
+	"testing"
+)
+
+// one producer hammers the ring with synthetic events while one consumer drains it, like `Send` and `process`
+func TestEventRingStress(t *testing.T) {
+	const sent = 1000000
+
+	var ring eventRing
+	overflow := make(chan int)
+
+	go func() {
+		dropped := 0
+		for i := uint32(0); i < sent; i++ {
+			if !ring.push(jackEvent{capture: i, target: i, data: []byte{byte(i)}}) {
+				dropped += 1
+			}
+			if i%ringSize == 0 {
+				runtime.Gosched() // lets consumer catch up sometimes, so both full and empty ring is seen
+			}
+		}
+		overflow <- dropped
+	}()
+
+	delivered, dropped, next := 0, -1, uint32(0)
+	for dropped < 0 || ring.len() > 0 {
+		event, ok := ring.peek()
+		if !ok {
+			select {
+			case dropped = <-overflow:
+			default:
+				runtime.Gosched()
+			}
+			continue
+		}
+
+		if event.capture < next || event.target != event.capture || event.data[0] != byte(event.capture) {
+			t.Fatalf("event %d (%d, %v) after %d, FIFO order is broken", event.capture, event.target, event.data, next)
+		}
+		next = event.capture + 1
+		ring.pop()
+		delivered += 1
+	}
+
+	if delivered+dropped != sent {
+		t.Fatalf("delivered %d + overflow %d != sent %d", delivered, dropped, sent)
+	}
+	if delivered == 0 {
+		t.Fatalf("nothing delivered")
+	}
+	t.Logf("delivered: %d, overflow: %d", delivered, dropped)
+}
@@ -0,0 +1,76 @@
+// Package sink provides midi output backends, JACK and ALSA sequencer
+package sink
+
+import (
+	"fmt"
+	"keyboard3000/pkg/midi"
+	"time"
+)
+
+const (
+	Jack = "jack"
+	Alsa = "alsa"
+	File = "file" // JSON lines, to file or standard output
+)
+
+// Port is an output port opened by sink, one or more for every device
+type Port interface {
+	Name() string
+}
+
+// MidiSink is a midi output backend
+type MidiSink interface {
+	// OpenPort registers new output port, name is suffixed if it's already taken
+	OpenPort(name string) (Port, error)
+	ClosePort(port Port)
+
+	// Connect connects port to destination port given by name, e.g. "amsynth:midi_in"
+	Connect(port Port, target string) error
+
+	// Send sends (or queues) message to given port, at is capture time of the event (e.g. key press timestamp),
+	// backends with scheduling send it with constant latency from that time
+	Send(port Port, message midi.Message, at time.Time)
+
+	// Status returns backend state for devices view
+	Status() string
+
+	Close()
+}
+
+// Transport is JACK transport state at the time it was queried
+type Transport struct {
+	Rolling bool
+	Frame   uint32
+	BBT     bool // bar, beat, tick and tempo are provided by transport master
+	Bar     int32
+	Beat    int32
+	Tick    int32
+	Tempo   float64
+}
+
+// ClockSource is implemented by sinks which provide transport state and midi clock input, JACK only for now
+type ClockSource interface {
+	// Transport queries transport state in caller's thread
+	Transport() Transport
+
+	// FollowTransport polls transport on its own goroutine and passes it to handler, until sink is closed
+	FollowTransport(handler func(transport Transport))
+
+	// OpenClockInput registers input port, realtime messages received in process callback are passed to handler
+	// from separate goroutine shortly after, with their capture time
+	OpenClockInput(name string, handler func(message midi.Message, at time.Time)) error
+}
+
+// New opens sink of given backend, onShutdown is called when backend goes away by itself (e.g. JACK server stop),
+// output is a path of file backend ("-" for standard output), latency is JACK scheduling latency (one period if zero)
+func New(backend string, client string, output string, latency time.Duration, onShutdown func()) (MidiSink, error) {
+	switch backend {
+	case Jack:
+		return NewJack(client, latency, onShutdown)
+	case Alsa:
+		return NewAlsa(client)
+	case File:
+		return NewFile(output)
+	}
+	return nil, fmt.Errorf("unknown midi backend \"%s\"", backend)
+}
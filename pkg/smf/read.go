@@ -0,0 +1,264 @@
+package smf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"keyboard3000/pkg/midi"
+	"sort"
+	"time"
+)
+
+// Song is a Standard MIDI File with every track merged into single, time ordered event list
+type Song struct {
+	Events []Event
+	Length time.Duration // end of the longest track, loop length
+}
+
+// Event is midi message at given time from the song start
+type Event struct {
+	Time    time.Duration
+	Message midi.Message
+}
+
+// track event before tempo map is applied
+type tickEvent struct {
+	tick    uint64
+	message midi.Message
+	tempo   uint32 // microseconds per quarter note, tempo change if message is nil
+}
+
+func ReadFile(path string) (Song, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Song{}, err
+	}
+	return Read(data)
+}
+
+// Read parses format 0 and 1 files, format 2 (independent sequences) is not supported
+func Read(data []byte) (Song, error) {
+	chunk, data, err := readChunk(data, "MThd")
+	if err != nil {
+		return Song{}, err
+	}
+	if len(chunk) < 6 {
+		return Song{}, fmt.Errorf("header too short")
+	}
+	format := binary.BigEndian.Uint16(chunk[0:2])
+	tracks := int(binary.BigEndian.Uint16(chunk[2:4]))
+	division := binary.BigEndian.Uint16(chunk[4:6])
+
+	if format > 1 {
+		return Song{}, fmt.Errorf("format %d is not supported", format)
+	}
+	if division == 0 {
+		return Song{}, fmt.Errorf("invalid time division")
+	}
+
+	var events []tickEvent
+	var end uint64
+	for i := 0; i < tracks; i++ {
+		chunk, data, err = readChunk(data, "MTrk")
+		if err != nil {
+			return Song{}, fmt.Errorf("track %d: %s", i+1, err)
+		}
+		trackEvents, trackEnd, err := readTrack(chunk)
+		if err != nil {
+			return Song{}, fmt.Errorf("track %d: %s", i+1, err)
+		}
+		events = append(events, trackEvents...)
+		if trackEnd > end {
+			end = trackEnd
+		}
+	}
+
+	// merged tracks keep their order for events of the same tick
+	sort.SliceStable(events, func(i, j int) bool { return events[i].tick < events[j].tick })
+
+	clock := newClock(division)
+	var song Song
+	for _, event := range events {
+		if event.message == nil {
+			clock.setTempo(event.tick, event.tempo)
+			continue
+		}
+		song.Events = append(song.Events, Event{clock.time(event.tick), event.message})
+	}
+	song.Length = clock.time(end)
+
+	return song, nil
+}
+
+func readChunk(data []byte, chunkType string) ([]byte, []byte, error) {
+	for {
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("%s chunk expected, end of file found", chunkType)
+		}
+		length := binary.BigEndian.Uint32(data[4:8])
+		if uint64(len(data)-8) < uint64(length) {
+			return nil, nil, fmt.Errorf("%s chunk is truncated", string(data[0:4]))
+		}
+		if string(data[0:4]) == chunkType {
+			return data[8 : 8+length], data[8+length:], nil
+		}
+		data = data[8+length:] // unknown chunks are skipped, as specification says
+	}
+}
+
+// returns track events and end of track tick, unsupported events (e.g. text meta events) are skipped
+func readTrack(data []byte) ([]tickEvent, uint64, error) {
+	var events []tickEvent
+	var tick uint64
+	var running byte
+	reader := bytes.NewReader(data)
+
+	for reader.Len() > 0 {
+		delta, err := readVarLen(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		tick += delta
+
+		status, err := reader.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case status == 0xff: // meta event
+			metaType, err := reader.ReadByte()
+			if err != nil {
+				return nil, 0, err
+			}
+			payload, err := readPayload(reader)
+			if err != nil {
+				return nil, 0, err
+			}
+			switch metaType {
+			case metaEndOfTrack:
+				return events, tick, nil
+			case metaTempo:
+				if len(payload) == 3 {
+					tempo := uint32(payload[0])<<16 | uint32(payload[1])<<8 | uint32(payload[2])
+					events = append(events, tickEvent{tick: tick, tempo: tempo})
+				}
+			}
+		case status == midi.SysExStart:
+			payload, err := readPayload(reader)
+			if err != nil {
+				return nil, 0, err
+			}
+			events = append(events, tickEvent{tick: tick, message: append(midi.Message{midi.SysExStart}, payload...)})
+		case status == midi.SysExEnd: // escaped data, e.g. SysEx continuation packets, can't be replayed safely
+			if _, err := readPayload(reader); err != nil {
+				return nil, 0, err
+			}
+		default:
+			if status < 0x80 { // running status, status byte is the first data byte
+				if running == 0 {
+					return nil, 0, fmt.Errorf("running status without previous status")
+				}
+				reader.UnreadByte()
+				status = running
+			} else if status < midi.SysExStart {
+				running = status
+			}
+
+			message := midi.Message{status}
+			for i := 0; i < dataLength(status); i++ {
+				b, err := reader.ReadByte()
+				if err != nil {
+					return nil, 0, err
+				}
+				message = append(message, b)
+			}
+			events = append(events, tickEvent{tick: tick, message: message})
+		}
+	}
+
+	return events, tick, nil // end of track event is missing, never mind
+}
+
+func dataLength(status byte) int {
+	switch status & 0xf0 {
+	case midi.ProgramChange, midi.ChannelPressure:
+		return 1
+	case 0xf0:
+		switch status {
+		case midi.SongPosition:
+			return 2
+		case midi.SongSelect, midi.TimeCodeQuarterFrame:
+			return 1
+		}
+		return 0
+	}
+	return 2
+}
+
+func readPayload(reader *bytes.Reader) ([]byte, error) {
+	length, err := readVarLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(reader.Len()) {
+		return nil, fmt.Errorf("event is truncated")
+	}
+	payload := make([]byte, length)
+	reader.Read(payload)
+	return payload, nil
+}
+
+func readVarLen(reader *bytes.Reader) (uint64, error) {
+	var value uint64
+	for i := 0; i < 4; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("variable-length quantity too long")
+}
+
+// converts ticks to time with tempo changes applied, ticks are expected in non-decreasing order
+type clock struct {
+	division  uint16
+	tempo     uint32 // microseconds per quarter note
+	tick      uint64 // tick of last tempo change
+	elapsed   time.Duration
+	perSecond float64 // ticks per second of SMPTE division, zero for metrical one
+}
+
+func newClock(division uint16) *clock {
+	c := &clock{division: division, tempo: 500000} // 120 BPM is default
+	if division&0x8000 != 0 {
+		framesPerSecond := -float64(int8(division >> 8))
+		if framesPerSecond == 29 {
+			framesPerSecond = 29.97
+		}
+		c.perSecond = framesPerSecond * float64(division&0xff)
+	}
+	return c
+}
+
+func (c *clock) time(tick uint64) time.Duration {
+	if c.perSecond > 0 {
+		return time.Duration(float64(tick) / c.perSecond * float64(time.Second))
+	}
+	ticks := float64(tick - c.tick)
+	return c.elapsed + time.Duration(ticks*float64(c.tempo)/float64(c.division)*float64(time.Microsecond))
+}
+
+func (c *clock) setTempo(tick uint64, tempo uint32) {
+	if tempo == 0 {
+		return
+	}
+	c.elapsed = c.time(tick)
+	c.tick = tick
+	c.tempo = tempo
+}
@@ -0,0 +1,177 @@
+// Package smf records midi events into Standard MIDI Files
+package smf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"keyboard3000/pkg/midi"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	Resolution = 960 // ticks per quarter note
+	Tempo      = 120 // BPM of recorded files, ticks are derived from real time anyway
+
+	metaTrackName     = 0x03
+	metaEndOfTrack    = 0x2f
+	metaTempo         = 0x51
+	metaTimeSignature = 0x58
+)
+
+// Recorder collects events of every device into its own track, file is written by Save()
+type Recorder struct {
+	mutex  sync.Mutex
+	path   string
+	start  time.Time
+	tracks []*track
+	named  map[string]*track
+	events uint64
+}
+
+type track struct {
+	data bytes.Buffer
+	tick uint64 // tick of last written event
+}
+
+// NewRecorder starts recording, event times are counted from now
+func NewRecorder(path string) *Recorder {
+	return &Recorder{path: path, start: time.Now(), named: make(map[string]*track)}
+}
+
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+// Record adds message to the track of given name, track is created with first message.
+// Realtime and system common messages are skipped, they have no place in Standard MIDI File
+func (r *Recorder) Record(trackName string, at time.Time, message midi.Message) {
+	if message.Validate() != nil || message.IsRealtime() {
+		return
+	}
+	status := message.Status()
+	if status > midi.SysExStart && status <= midi.SysExEnd {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, ok := r.named[trackName]
+	if !ok {
+		t = &track{}
+		writeMeta(&t.data, 0, metaTrackName, []byte(trackName))
+		r.tracks = append(r.tracks, t)
+		r.named[trackName] = t
+	}
+
+	tick := r.ticks(at)
+	if tick < t.tick { // timers and key events may come slightly out of order, track time can't go back
+		tick = t.tick
+	}
+	delta := tick - t.tick
+	t.tick = tick
+
+	writeVarLen(&t.data, delta)
+	if status == midi.SysExStart { // F0, length, data with F7
+		t.data.WriteByte(midi.SysExStart)
+		writeVarLen(&t.data, uint64(len(message)-1))
+		t.data.Write(message[1:])
+	} else {
+		t.data.Write(message)
+	}
+	r.events += 1
+}
+
+func (r *Recorder) ticks(at time.Time) uint64 {
+	elapsed := at.Sub(r.start)
+	if elapsed < 0 {
+		return 0
+	}
+	return uint64(elapsed.Seconds()*Tempo/60*Resolution + 0.5)
+}
+
+// Save writes format 1 file, first track holds tempo and time signature, then one track per device.
+// File is written next to the target and renamed, so it's never left half-written
+func (r *Recorder) Save() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var file bytes.Buffer
+	file.WriteString("MThd")
+	binary.Write(&file, binary.BigEndian, uint32(6))
+	binary.Write(&file, binary.BigEndian, []uint16{1, uint16(len(r.tracks) + 1), Resolution}) // format, tracks, division
+
+	var conductor bytes.Buffer
+	microseconds := uint32(60000000 / Tempo)
+	writeMeta(&conductor, 0, metaTempo, []byte{byte(microseconds >> 16), byte(microseconds >> 8), byte(microseconds)})
+	writeMeta(&conductor, 0, metaTimeSignature, []byte{4, 2, 24, 8})
+	writeChunk(&file, conductor.Bytes())
+
+	for _, t := range r.tracks {
+		writeChunk(&file, t.data.Bytes())
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(file.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func (r *Recorder) Status() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return fmt.Sprintf(
+		"recording \"%s\", tracks: %d, events: %d, time: %s",
+		r.path, len(r.tracks), r.events, time.Since(r.start).Truncate(time.Second),
+	)
+}
+
+// writes track chunk, end of track event is appended
+func writeChunk(buffer *bytes.Buffer, events []byte) {
+	var end bytes.Buffer
+	writeMeta(&end, 0, metaEndOfTrack, nil)
+
+	buffer.WriteString("MTrk")
+	binary.Write(buffer, binary.BigEndian, uint32(len(events)+end.Len()))
+	buffer.Write(events)
+	buffer.Write(end.Bytes())
+}
+
+func writeMeta(buffer *bytes.Buffer, delta uint64, metaType byte, data []byte) {
+	writeVarLen(buffer, delta)
+	buffer.Write([]byte{0xff, metaType})
+	writeVarLen(buffer, uint64(len(data)))
+	buffer.Write(data)
+}
+
+// variable-length quantity, 7 bits per byte, most significant first
+func writeVarLen(buffer *bytes.Buffer, value uint64) {
+	var encoded [10]byte
+	i := len(encoded) - 1
+	encoded[i] = byte(value & 0x7f)
+	for value >>= 7; value > 0; value >>= 7 {
+		i--
+		encoded[i] = byte(value&0x7f) | 0x80
+	}
+	buffer.Write(encoded[i:])
+}